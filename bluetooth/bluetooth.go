@@ -30,20 +30,21 @@
 package bluetooth
 
 import (
-	"fmt"
+	"errors"
 	"sync"
 
 	"gitlab.com/jtaimisto/bluewalker/filter"
-	"gitlab.com/jtaimisto/bluewalker/hci"
 	"gitlab.com/jtaimisto/bluewalker/host"
 )
 
 // Scanner scans for Bluetooth LE advertisements.
 type Scanner struct {
 	device   string
+	source   Source
 	active   bool
 	filters  []filter.AdFilter
 	log      Logger
+	record   AdvertisementHandler
 	handlers []AdvertisementHandler
 
 	quitOnce sync.Once
@@ -53,6 +54,15 @@ type Scanner struct {
 type ScannerOpts struct {
 	Device string
 	Logger Logger
+
+	// Source is the source of advertisements. If nil, the raw HCI
+	// socket of Device is used.
+	Source Source
+
+	// Record, if set, is called on the scan loop with every
+	// advertisement before it is passed to the handlers, so that the
+	// advertisements are recorded in the order received.
+	Record AdvertisementHandler
 }
 
 // Logger is a log.Logger compatible logger.
@@ -64,12 +74,17 @@ type Logger interface {
 func New(opts ScannerOpts) *Scanner {
 	s := &Scanner{
 		device:  opts.Device,
+		source:  opts.Source,
 		log:     opts.Logger,
+		record:  opts.Record,
 		active:  false,
 		filters: filterVendorIsRuuvi(),
 
 		quit: make(chan struct{}),
 	}
+	if s.source == nil {
+		s.source = &hciSource{device: opts.Device}
+	}
 	return s
 }
 
@@ -83,29 +98,31 @@ func filterVendorIsRuuvi() []filter.AdFilter {
 
 type AdvertisementHandler func(*host.ScanReport)
 
+// errSourceClosed is returned by Scan if the source stops sending
+// advertisements before the scanner is shut down.
+var errSourceClosed = errors.New("advertisement source closed unexpectedly")
+
+// Scan receives advertisements from the source and dispatches them to
+// the handlers until Shutdown is called or the source fails.
 func (s *Scanner) Scan() error {
 	s.log.Printf("Using device %v", s.device)
 
-	raw, err := hci.Raw(s.device)
+	reportChan, err := s.source.Start(s.active, s.filters)
 	if err != nil {
-		return fmt.Errorf(`error while opening RAW HCI socket: %v
-	Are you running as root and have you run sudo hciconfig %s down?`, err, s.device)
-	}
-
-	host := host.New(raw)
-	if err = host.Init(); err != nil {
-		return fmt.Errorf("unable to initialize host: %v", err)
-	}
-
-	reportChan, err := host.StartScanning(s.active, s.filters)
-	if err != nil {
-		return fmt.Errorf("unable to start scanning: %v", err)
+		return err
 	}
 
 receiveLoop:
 	for {
 		select {
-		case sr := <-reportChan:
+		case sr, ok := <-reportChan:
+			if !ok {
+				err = errSourceClosed
+				break receiveLoop
+			}
+			if s.record != nil {
+				s.record(sr)
+			}
 			for _, handle := range s.handlers {
 				go handle(sr)
 			}
@@ -115,11 +132,12 @@ receiveLoop:
 	}
 
 	s.log.Print("Requesting to stop scan")
-	err = host.StopScanning()
-	if err != nil {
-		s.log.Printf("failed to stop scanning: %v", err)
+	if stopErr := s.source.Stop(); stopErr != nil {
+		s.log.Printf("failed to stop scanning: %v", stopErr)
+		if err == nil {
+			err = stopErr
+		}
 	}
-	host.Deinit()
 
 	s.Shutdown()
 	return err
@@ -0,0 +1,156 @@
+package bluetooth
+
+import (
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/jtaimisto/bluewalker/host"
+)
+
+func newTestScanner(source Source) *Scanner {
+	return New(ScannerOpts{
+		Device: "fake0",
+		Logger: log.New(io.Discard, "", 0),
+		Source: source,
+	})
+}
+
+// scan runs s.Scan in the background and returns a channel receiving
+// its result.
+func scan(s *Scanner) <-chan error {
+	done := make(chan error, 1)
+	go func() { done <- s.Scan() }()
+	return done
+}
+
+func waitScan(t *testing.T, done <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("Scan did not return")
+		return nil
+	}
+}
+
+func TestScannerDispatch(t *testing.T) {
+	source := NewFakeSource()
+	s := newTestScanner(source)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	received := make(map[string]int)
+	for _, name := range []string{"first", "second"} {
+		name := name
+		s.HandleAdvertisement(func(sr *host.ScanReport) {
+			mu.Lock()
+			received[name]++
+			mu.Unlock()
+			wg.Done()
+		})
+	}
+
+	done := scan(s)
+	wg.Add(2 * 3)
+	for i := 0; i < 3; i++ {
+		source.Send(&host.ScanReport{Rssi: -60})
+	}
+	wg.Wait()
+
+	if received["first"] != 3 || received["second"] != 3 {
+		t.Errorf("handlers received %v, expected 3 reports each", received)
+	}
+
+	s.Shutdown()
+	if err := waitScan(t, done); err != nil {
+		t.Errorf("Scan = %v, expected nil after Shutdown", err)
+	}
+	if !source.Stopped() {
+		t.Error("source not stopped after Shutdown")
+	}
+}
+
+// TestScannerRecord checks that the recording handler receives the
+// advertisements in order before the handlers.
+func TestScannerRecord(t *testing.T) {
+	source := NewFakeSource()
+	var recorded []int8
+	s := New(ScannerOpts{
+		Device: "fake0",
+		Logger: log.New(io.Discard, "", 0),
+		Source: source,
+		Record: func(sr *host.ScanReport) { recorded = append(recorded, sr.Rssi) },
+	})
+	var wg sync.WaitGroup
+	s.HandleAdvertisement(func(*host.ScanReport) { wg.Done() })
+
+	done := scan(s)
+	wg.Add(20)
+	for i := 0; i < 20; i++ {
+		source.Send(&host.ScanReport{Rssi: int8(-i)})
+	}
+	wg.Wait()
+	s.Shutdown()
+	waitScan(t, done)
+
+	for i, rssi := range recorded {
+		if rssi != int8(-i) {
+			t.Fatalf("recorded %v, expected in order sent", recorded)
+		}
+	}
+	if len(recorded) != 20 {
+		t.Errorf("recorded %d advertisements, expected 20", len(recorded))
+	}
+}
+
+func TestScannerShutdownIdempotent(t *testing.T) {
+	source := NewFakeSource()
+	s := newTestScanner(source)
+	done := scan(s)
+	<-source.Started()
+	s.Shutdown()
+	s.Shutdown()
+	if err := waitScan(t, done); err != nil {
+		t.Errorf("Scan = %v, expected nil", err)
+	}
+}
+
+func TestScannerStartError(t *testing.T) {
+	source := NewFakeSource()
+	source.StartErr = errors.New("no adapter")
+	s := newTestScanner(source)
+	if err := waitScan(t, scan(s)); err != source.StartErr {
+		t.Errorf("Scan = %v, expected %v", err, source.StartErr)
+	}
+}
+
+func TestScannerStopError(t *testing.T) {
+	source := NewFakeSource()
+	source.StopErr = errors.New("stop failed")
+	s := newTestScanner(source)
+	done := scan(s)
+	<-source.Started()
+	s.Shutdown()
+	if err := waitScan(t, done); err != source.StopErr {
+		t.Errorf("Scan = %v, expected %v", err, source.StopErr)
+	}
+}
+
+func TestScannerSourceFailure(t *testing.T) {
+	source := NewFakeSource()
+	s := newTestScanner(source)
+	done := scan(s)
+	<-source.Started()
+	source.Fail()
+	if err := waitScan(t, done); err != errSourceClosed {
+		t.Errorf("Scan = %v, expected %v", err, errSourceClosed)
+	}
+	if !source.Stopped() {
+		t.Error("source not stopped after failure")
+	}
+}
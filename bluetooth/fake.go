@@ -0,0 +1,98 @@
+// Copyright (c) 2018, Joonas Kuorilehto
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package bluetooth
+
+import (
+	"sync"
+
+	"gitlab.com/jtaimisto/bluewalker/filter"
+	"gitlab.com/jtaimisto/bluewalker/host"
+)
+
+// FakeSource is an in-memory Source for tests. Advertisements sent with
+// Send are delivered to the scanner as is; the filters given to Start
+// are not applied.
+type FakeSource struct {
+	// StartErr is returned from Start if set.
+	StartErr error
+
+	// StopErr is returned from Stop if set.
+	StopErr error
+
+	reports chan *host.ScanReport
+
+	mu        sync.Mutex
+	started   chan struct{}
+	stopped   bool
+	closeOnce sync.Once
+}
+
+// NewFakeSource returns a new FakeSource.
+func NewFakeSource() *FakeSource {
+	return &FakeSource{
+		reports: make(chan *host.ScanReport),
+		started: make(chan struct{}),
+	}
+}
+
+func (f *FakeSource) Start(active bool, filters []filter.AdFilter) (<-chan *host.ScanReport, error) {
+	if f.StartErr != nil {
+		return nil, f.StartErr
+	}
+	close(f.started)
+	return f.reports, nil
+}
+
+func (f *FakeSource) Stop() error {
+	f.mu.Lock()
+	f.stopped = true
+	f.mu.Unlock()
+	return f.StopErr
+}
+
+// Started returns a channel that is closed when scanning is started.
+func (f *FakeSource) Started() <-chan struct{} {
+	return f.started
+}
+
+// Stopped reports whether Stop has been called.
+func (f *FakeSource) Stopped() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.stopped
+}
+
+// Send delivers sr to the scanner. It blocks until the scanner receives
+// it.
+func (f *FakeSource) Send(sr *host.ScanReport) {
+	f.reports <- sr
+}
+
+// Fail closes the report channel, as a failing source does.
+func (f *FakeSource) Fail() {
+	f.closeOnce.Do(func() {
+		close(f.reports)
+	})
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2018, Joonas Kuorilehto
+// All rights reserved.
+//
+// Derived from bluewalker by Jukka Taimisto.
+//
+// Copyright (c) 2018, Jukka Taimisto
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package bluetooth
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"gitlab.com/jtaimisto/bluewalker/filter"
+	"gitlab.com/jtaimisto/bluewalker/hci"
+	"gitlab.com/jtaimisto/bluewalker/host"
+)
+
+// Source is a source of Bluetooth LE advertisements for Scanner.
+type Source interface {
+	// Start starts scanning and returns the channel receiving
+	// advertisements accepted by filters. The channel is closed if the
+	// source fails.
+	Start(active bool, filters []filter.AdFilter) (<-chan *host.ScanReport, error)
+
+	// Stop stops scanning and releases the resources of the source.
+	Stop() error
+}
+
+// hciSource receives advertisements from a Bluetooth adapter through a
+// raw HCI socket.
+type hciSource struct {
+	device string
+	host   *host.Host
+	quit   chan struct{}
+}
+
+func (s *hciSource) Start(active bool, filters []filter.AdFilter) (<-chan *host.ScanReport, error) {
+	raw, err := hci.Raw(s.device)
+	if err != nil {
+		return nil, fmt.Errorf(`error while opening RAW HCI socket: %v
+	Are you running as root and have you run sudo hciconfig %s down?`, err, s.device)
+	}
+
+	tr := newFailTransport(raw)
+	s.host = host.New(tr)
+	if err = s.host.Init(); err != nil {
+		return nil, fmt.Errorf("unable to initialize host: %v", err)
+	}
+
+	reportChan, err := s.host.StartScanning(active, filters)
+	if err != nil {
+		return nil, fmt.Errorf("unable to start scanning: %v", err)
+	}
+	s.quit = make(chan struct{})
+	out := make(chan *host.ScanReport)
+	go forwardReports(reportChan, out, tr.failed, s.quit)
+	return out, nil
+}
+
+func (s *hciSource) Stop() error {
+	close(s.quit)
+	err := s.host.StopScanning()
+	s.host.Deinit()
+	return err
+}
+
+// forwardReports passes the reports from in to out until quit is closed.
+// out is closed if failed is closed, as host never closes in.
+func forwardReports(in <-chan *host.ScanReport, out chan<- *host.ScanReport, failed, quit <-chan struct{}) {
+	for {
+		select {
+		case sr := <-in:
+			select {
+			case out <- sr:
+			case <-quit:
+				return
+			}
+		case <-failed:
+			close(out)
+			return
+		case <-quit:
+			return
+		}
+	}
+}
+
+// failTransport is a transport that closes failed when a read fails.
+// The host logs read errors and keeps reading, so the adapter going
+// away would otherwise go unnoticed.
+type failTransport struct {
+	hci.Transport
+	failed chan struct{}
+	once   sync.Once
+}
+
+func newFailTransport(tr hci.Transport) *failTransport {
+	return &failTransport{Transport: tr, failed: make(chan struct{})}
+}
+
+func (t *failTransport) Read() ([]byte, error) {
+	buf, err := t.Transport.Read()
+	var again hci.ErrReadAgain
+	if err != nil && !errors.As(err, &again) {
+		t.once.Do(func() { close(t.failed) })
+	}
+	return buf, err
+}
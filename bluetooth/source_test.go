@@ -0,0 +1,61 @@
+package bluetooth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gitlab.com/jtaimisto/bluewalker/hci"
+	"gitlab.com/jtaimisto/bluewalker/host"
+)
+
+// readTransport is a transport returning the queued read errors.
+type readTransport struct {
+	hci.Transport
+	errs []error
+}
+
+func (t *readTransport) Read() ([]byte, error) {
+	err := t.errs[0]
+	t.errs = t.errs[1:]
+	return nil, err
+}
+
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// TestSourceReadError checks that the reports channel is closed when
+// reading from the adapter fails, but not when the read is retried.
+func TestSourceReadError(t *testing.T) {
+	tr := newFailTransport(&readTransport{errs: []error{hci.ErrReadAgain{}, errors.New("network is down")}})
+	in := make(chan *host.ScanReport)
+	out := make(chan *host.ScanReport)
+	quit := make(chan struct{})
+	defer close(quit)
+	go forwardReports(in, out, tr.failed, quit)
+
+	tr.Read()
+	if isClosed(tr.failed) {
+		t.Fatal("failed after read retry")
+	}
+	in <- &host.ScanReport{Rssi: -60}
+	if sr := <-out; sr.Rssi != -60 {
+		t.Errorf("forwarded rssi %d, expected -60", sr.Rssi)
+	}
+
+	tr.Read()
+	select {
+	case _, ok := <-out:
+		if ok {
+			t.Error("report received after read error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reports channel not closed after read error")
+	}
+}
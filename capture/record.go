@@ -0,0 +1,261 @@
+// Copyright (c) 2018, Joonas Kuorilehto
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package capture
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"gitlab.com/jtaimisto/bluewalker/hci"
+	"gitlab.com/jtaimisto/bluewalker/host"
+)
+
+const (
+	// DefaultMaxSize is the default size in bytes after which the
+	// recording file is rotated.
+	DefaultMaxSize = 10 << 20
+
+	// DefaultMaxBackups is the default number of rotated recording
+	// files kept.
+	DefaultMaxBackups = 5
+)
+
+// RecorderOpts are the options for creating a Recorder.
+type RecorderOpts struct {
+	// Path is the recording file name. Rotated files are named
+	// Path.1, Path.2 and so on, Path.1 being the most recent.
+	Path string
+
+	// MaxSize is the size in bytes after which the recording file is
+	// rotated, DefaultMaxSize if zero.
+	MaxSize int64
+
+	// MaxBackups is the number of rotated files kept,
+	// DefaultMaxBackups if zero.
+	MaxBackups int
+}
+
+// Recorder writes received advertisements to a rotating JSON lines
+// file, which can be replayed with Replay.
+type Recorder struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+	err  error // first error from Record
+}
+
+// jsonRecord is the JSON lines representation of a Record.
+type jsonRecord struct {
+	Time        time.Time   `json:"time"`
+	Address     string      `json:"address"`
+	AddressType string      `json:"address_type"`
+	EventType   hci.AdvType `json:"event_type"`
+	Rssi        int8        `json:"rssi"`
+	Data        []jsonAD    `json:"data"`
+}
+
+// jsonAD is the JSON representation of an AD structure, with the data
+// in hex.
+type jsonAD struct {
+	Type hci.AdType `json:"type"`
+	Data string     `json:"data"`
+}
+
+// NewRecorder creates a Recorder appending to the file opts.Path.
+func NewRecorder(opts RecorderOpts) (*Recorder, error) {
+	if opts.MaxSize == 0 {
+		opts.MaxSize = DefaultMaxSize
+	}
+	if opts.MaxBackups == 0 {
+		opts.MaxBackups = DefaultMaxBackups
+	}
+	r := &Recorder{
+		path:       opts.Path,
+		maxSize:    opts.MaxSize,
+		maxBackups: opts.MaxBackups,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Recorder) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = st.Size()
+	return nil
+}
+
+// Record writes the advertisement sr, received now, to the recording.
+// Record is the recording handler for bluetooth.Scanner; the time is
+// taken under the lock so that the records of several scanners are in
+// time order. The first error is returned from Close.
+func (r *Recorder) Record(sr *host.ScanReport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.write(Record{Time: time.Now(), Report: sr}); err != nil && r.err == nil {
+		r.err = err
+	}
+}
+
+// Write writes rec to the recording, rotating the file first if it
+// would grow over the maximum size.
+func (r *Recorder) Write(rec Record) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.write(rec)
+}
+
+// write writes rec to the recording. If rotating the file fails, the
+// record is appended to the current file and the error returned. r.mu
+// must be held.
+func (r *Recorder) write(rec Record) error {
+	line, err := marshalRecord(rec)
+	if err != nil {
+		return err
+	}
+	if r.f == nil {
+		return os.ErrClosed
+	}
+	var rotateErr error
+	if r.size > 0 && r.size+int64(len(line)) > r.maxSize {
+		rotateErr = r.rotate()
+		if r.f == nil {
+			return rotateErr
+		}
+	}
+	n, err := r.f.Write(line)
+	r.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return err
+}
+
+// rotate closes the current file, renames it and the previous backups
+// and opens a new file. If renaming fails, the current file is opened
+// again. r.f is nil after rotate only if no file could be opened. r.mu
+// must be held.
+func (r *Recorder) rotate() error {
+	err := r.f.Close()
+	r.f = nil
+	if err == nil {
+		os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxBackups))
+		for i := r.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		err = os.Rename(r.path, r.path+".1")
+	}
+	if openErr := r.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+// Close closes the recording file. It returns the first error from
+// Record, if any.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return r.err
+	}
+	err := r.f.Close()
+	r.f = nil
+	if r.err != nil {
+		return r.err
+	}
+	return err
+}
+
+func marshalRecord(rec Record) ([]byte, error) {
+	sr := rec.Report
+	jr := jsonRecord{
+		Time:        rec.Time,
+		Address:     sr.Address.String(),
+		AddressType: sr.Address.Atype.String(),
+		EventType:   sr.Type,
+		Rssi:        sr.Rssi,
+		Data:        make([]jsonAD, len(sr.Data)),
+	}
+	for i, ad := range sr.Data {
+		jr.Data[i] = jsonAD{Type: ad.Typ, Data: hex.EncodeToString(ad.Data)}
+	}
+	line, err := json.Marshal(jr)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+func unmarshalRecord(line []byte) (Record, error) {
+	var jr jsonRecord
+	if err := json.Unmarshal(line, &jr); err != nil {
+		return Record{}, err
+	}
+	addr, err := hci.BtAddressFromString(jr.Address)
+	if err != nil {
+		return Record{}, err
+	}
+	switch jr.AddressType {
+	case hci.LePublicAddress.String(), "":
+		addr.Atype = hci.LePublicAddress
+	case hci.LeRandomAddress.String():
+		addr.Atype = hci.LeRandomAddress
+	default:
+		return Record{}, fmt.Errorf("unsupported address type %q", jr.AddressType)
+	}
+	sr := &host.ScanReport{
+		Type:    jr.EventType,
+		Address: addr,
+		Rssi:    jr.Rssi,
+		Data:    make([]*hci.AdStructure, len(jr.Data)),
+	}
+	for i, ad := range jr.Data {
+		data, err := hex.DecodeString(ad.Data)
+		if err != nil {
+			return Record{}, fmt.Errorf("invalid data: %v", err)
+		}
+		sr.Data[i] = &hci.AdStructure{Typ: ad.Type, Data: data}
+	}
+	return Record{Time: jr.Time, Report: sr}, nil
+}
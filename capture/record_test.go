@@ -0,0 +1,139 @@
+package capture
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"gitlab.com/jtaimisto/bluewalker/hci"
+	"gitlab.com/jtaimisto/bluewalker/host"
+)
+
+func testRecord(t *testing.T) Record {
+	t.Helper()
+	addr, err := hci.BtAddressFromString("ee:36:80:be:ec:fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr.Atype = hci.LeRandomAddress
+	return Record{
+		Time: time.Date(2026, 7, 18, 19, 51, 26, 0, time.UTC),
+		Report: &host.ScanReport{
+			Type:    hci.AdvNonconnInd,
+			Address: addr,
+			Rssi:    -60,
+			Data: []*hci.AdStructure{
+				{Typ: hci.AdFlags, Data: []byte{0x06}},
+				{Typ: hci.AdManufacturerSpecific, Data: []byte{0x99, 0x04, 0x06, 0x12}},
+			},
+		},
+	}
+}
+
+// TestRecordReplay checks that recorded advertisements are read back
+// unchanged.
+func TestRecordReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	r, err := NewRecorder(RecorderOpts{Path: path})
+	if err != nil {
+		t.Fatalf("NewRecorder: %v", err)
+	}
+	want := testRecord(t)
+	if err := r.Write(want); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rd := NewReader(f)
+	got, err := rd.Read()
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if !got.Time.Equal(want.Time) {
+		t.Errorf("time = %v, expected %v", got.Time, want.Time)
+	}
+	got.Time = want.Time
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("read %+v, expected %+v", got.Report, want.Report)
+	}
+	if _, err := rd.Read(); err != io.EOF {
+		t.Errorf("Read at end = %v, expected io.EOF", err)
+	}
+}
+
+func TestRecorderRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	line, err := marshalRecord(testRecord(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Room for two records per file.
+	r, err := NewRecorder(RecorderOpts{Path: path, MaxSize: int64(2 * len(line)), MaxBackups: 2})
+	if err != nil {
+		t.Fatalf("NewRecorder: %v", err)
+	}
+	for i := 0; i < 7; i++ {
+		if err := r.Write(testRecord(t)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	for name, records := range map[string]int{path: 1, path + ".1": 2, path + ".2": 2} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := bytes.Count(data, []byte("\n")); got != records {
+			t.Errorf("%s has %d records, expected %d", filepath.Base(name), got, records)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 backups, stat %s.3: %v", filepath.Base(path), err)
+	}
+}
+
+// TestRecorderRotateError checks that recording continues in the
+// current file if it can not be rotated.
+func TestRecorderRotateError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	// A directory that is not empty can not be replaced by the file.
+	if err := os.MkdirAll(filepath.Join(path+".1", "keep"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	line, err := marshalRecord(testRecord(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRecorder(RecorderOpts{Path: path, MaxSize: int64(len(line)), MaxBackups: 1})
+	if err != nil {
+		t.Fatalf("NewRecorder: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		r.Record(testRecord(t).Report)
+	}
+	if err := r.Close(); err == nil {
+		t.Error("Close: expected the rotate error")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bytes.Count(data, []byte("\n")); got != 3 {
+		t.Errorf("%d records, expected 3", got)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2018, Joonas Kuorilehto
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package capture records received Ruuvi advertisements and replays
+// them, so that issues can be reproduced without a Bluetooth adapter.
+//
+// A capture is a text file with one advertisement per line, either in
+// the JSON lines format written by Recorder or in the simple format
+//
+//	2026-07-18T19:51:26.123Z ee:36:80:be:ec:fd -60 990406129...
+//
+// The fields are the reception time in RFC 3339 format, the device
+// address, RSSI in dBm and the manufacturer specific data in hex,
+// starting with the Ruuvi manufacturer ID 9904. Empty lines and lines
+// starting with # are ignored. The formats can be mixed in one file.
+package capture
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/jtaimisto/bluewalker/hci"
+	"gitlab.com/jtaimisto/bluewalker/host"
+)
+
+// Record is a recorded advertisement.
+type Record struct {
+	// Time is the time the advertisement was received.
+	Time time.Time
+
+	// Report is the received advertisement.
+	Report *host.ScanReport
+}
+
+// Reader reads advertisements from a capture.
+type Reader struct {
+	s    *bufio.Scanner
+	line int
+}
+
+// NewReader returns a Reader reading capture from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{s: bufio.NewScanner(r)}
+}
+
+// Read returns the next advertisement in the capture. At the end of the
+// capture, Read returns io.EOF.
+func (r *Reader) Read() (Record, error) {
+	for r.s.Scan() {
+		r.line++
+		line := strings.TrimSpace(r.s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var rec Record
+		var err error
+		if strings.HasPrefix(line, "{") {
+			rec, err = unmarshalRecord([]byte(line))
+		} else {
+			rec, err = parseLine(line)
+		}
+		if err != nil {
+			return Record{}, fmt.Errorf("line %d: %v", r.line, err)
+		}
+		return rec, nil
+	}
+	if err := r.s.Err(); err != nil {
+		return Record{}, err
+	}
+	return Record{}, io.EOF
+}
+
+func parseLine(line string) (Record, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 4 {
+		return Record{}, fmt.Errorf("expected 4 fields, got %d", len(fields))
+	}
+	ts, err := time.Parse(time.RFC3339Nano, fields[0])
+	if err != nil {
+		return Record{}, err
+	}
+	addr, err := hci.BtAddressFromString(fields[1])
+	if err != nil {
+		return Record{}, err
+	}
+	rssi, err := strconv.ParseInt(fields[2], 10, 8)
+	if err != nil {
+		return Record{}, fmt.Errorf("invalid RSSI: %v", err)
+	}
+	data, err := hex.DecodeString(fields[3])
+	if err != nil {
+		return Record{}, fmt.Errorf("invalid data: %v", err)
+	}
+	return Record{
+		Time: ts,
+		Report: &host.ScanReport{
+			Type:    hci.AdvNonconnInd,
+			Address: addr,
+			Rssi:    int8(rssi),
+			Data: []*hci.AdStructure{
+				{Typ: hci.AdManufacturerSpecific, Data: data},
+			},
+		},
+	}, nil
+}
+
+// Replay reads the capture from r and calls handle for each
+// advertisement with its recorded reception time. If realtime is true, the original intervals between
+// advertisements are kept; otherwise the capture is replayed as fast as
+// possible. Replay returns when the capture ends or ctx is done.
+func Replay(ctx context.Context, r io.Reader, realtime bool, handle func(Record)) error {
+	rd := NewReader(r)
+	var prev time.Time
+	for {
+		rec, err := rd.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if realtime && !prev.IsZero() && rec.Time.After(prev) {
+			t := time.NewTimer(rec.Time.Sub(prev))
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return ctx.Err()
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		prev = rec.Time
+		handle(rec)
+	}
+}
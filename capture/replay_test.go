@@ -0,0 +1,78 @@
+package capture
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testCapture = `# recorded on a test bench
+2026-07-18T19:51:26.000Z ee:36:80:be:ec:fd -60 99040612974b7cc625000903090700ffff8d94beecfd
+
+2026-07-18T19:51:26.050Z ee:36:80:be:ec:fd -71 99040612974b7cc625000903090700ffff8e95beecfd
+`
+
+func TestReader(t *testing.T) {
+	rd := NewReader(strings.NewReader(testCapture))
+
+	rec, err := rd.Read()
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if got := rec.Report.Address.String(); got != "ee:36:80:be:ec:fd" {
+		t.Errorf("address = %v, expected ee:36:80:be:ec:fd", got)
+	}
+	if rec.Report.Rssi != -60 {
+		t.Errorf("rssi = %v, expected -60", rec.Report.Rssi)
+	}
+	if want := time.Date(2026, 7, 18, 19, 51, 26, 0, time.UTC); !rec.Time.Equal(want) {
+		t.Errorf("time = %v, expected %v", rec.Time, want)
+	}
+	if len(rec.Report.Data) != 1 || len(rec.Report.Data[0].Data) != 22 {
+		t.Fatalf("unexpected data %v", rec.Report.Data)
+	}
+
+	if _, err := rd.Read(); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if _, err := rd.Read(); err != io.EOF {
+		t.Fatalf("Read at end = %v, expected io.EOF", err)
+	}
+}
+
+func TestReaderError(t *testing.T) {
+	rd := NewReader(strings.NewReader("# comment\n2026-07-18T19:51:26Z ee:36:80:be:ec:fd -60 zz\n"))
+	_, err := rd.Read()
+	if err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+		t.Errorf("Read error = %v, expected error on line 2", err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	var records []Record
+	start := time.Now()
+	err := Replay(context.Background(), strings.NewReader(testCapture), true, func(rec Record) {
+		records = append(records, rec)
+	})
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d records, expected 2", len(records))
+	}
+	if want := time.Date(2026, 7, 18, 19, 51, 26, 0, time.UTC); !records[0].Time.Equal(want) {
+		t.Errorf("time = %v, expected the recorded %v", records[0].Time, want)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("realtime replay took %v, expected at least 50ms", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = Replay(ctx, strings.NewReader(testCapture), false, func(Record) {})
+	if err != context.Canceled {
+		t.Errorf("Replay with canceled context = %v, expected context.Canceled", err)
+	}
+}
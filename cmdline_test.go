@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/joneskoo/ruuvi-prometheus/config"
+)
+
+func TestDeviceFlag(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+		err  bool
+	}{
+		{args: nil, want: []string{"hci0"}},
+		{args: []string{"-device", "hci1"}, want: []string{"hci1"}},
+		{args: []string{"-device", "hci0,hci1"}, want: []string{"hci0", "hci1"}},
+		{args: []string{"-device", "hci1", "-device", "hci2"}, want: []string{"hci1", "hci2"}},
+		{args: []string{"-device", "hci1,"}, err: true},
+		{args: []string{"-device", "hci1", "-device", "hci1"}, err: true},
+	}
+	for _, tt := range tests {
+		devices := []string{"hci0"}
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		fs.Var(&deviceFlag{value: &devices}, "device", "")
+		err := fs.Parse(tt.args)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%v: expected error", tt.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tt.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(devices, tt.want) {
+			t.Errorf("%v: devices = %v, expected %v", tt.args, devices, tt.want)
+		}
+	}
+}
+
+func TestDeviceFilter(t *testing.T) {
+	flags, err := config.NewFilter(nil, []string{"e7:37:3b:37:d9:74"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Parse([]byte("allow: [e7:37:3b]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dropped := 0
+	f := newDeviceFilter(flags, cfg, func() { dropped++ })
+	for addr, want := range map[string]bool{
+		"e7:37:3b:00:00:01": true,
+		"e7:37:3b:37:d9:74": false,
+		"ee:36:80:be:ec:fd": false,
+	} {
+		if got := f.Allowed(addr); got != want {
+			t.Errorf("Allowed(%s) = %v, expected %v", addr, got, want)
+		}
+	}
+	if dropped != 2 {
+		t.Errorf("%d dropped, expected 2", dropped)
+	}
+
+	// Reloading the configuration keeps the flags.
+	f.SetConfig(nil)
+	if !f.Allowed("ee:36:80:be:ec:fd") || f.Allowed("e7:37:3b:37:d9:74") {
+		t.Error("unexpected filter after reload")
+	}
+}
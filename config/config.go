@@ -0,0 +1,254 @@
+// Copyright (c) 2018, Joonas Kuorilehto
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package config implements the ruuvi-prometheus configuration file.
+//
+// The configuration file is YAML and assigns names, locations and
+// arbitrary extra labels to devices by MAC address:
+//
+//	devices:
+//	  "e7:37:3b:37:d9:74":
+//	    name: garage
+//	    location: indoors
+//	    labels:
+//	      id: "2"
+//	    expire: 15m
+//	    altitude: 42
+//	    calibration:
+//	      temperature: {offset: -0.5}
+//	      humidity: {scale: 1.02, offset: -1}
+//
+// Devices can be limited with allow and deny lists of address
+// patterns, see Filter:
+//
+//	allow:
+//	  - "e7:37:3b"
+//	deny:
+//	  - "e7:37:3b:37:d9:74"
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"gitlab.com/jtaimisto/bluewalker/hci"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the contents of the configuration file.
+type Config struct {
+	// Devices maps lower case device MAC addresses to device settings.
+	Devices map[string]Device `yaml:"devices"`
+
+	// Allow and Deny are the address patterns of the devices accepted
+	// and dropped. See Filter.
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// Device holds the settings of a single Ruuvi device.
+type Device struct {
+	Name     string            `yaml:"name"`
+	Location string            `yaml:"location"`
+	Labels   map[string]string `yaml:"labels"`
+
+	// Expire overrides the duration after which the device is
+	// considered lost, e.g. for tags advertising at slow intervals.
+	Expire time.Duration `yaml:"expire"`
+
+	// Altitude is the altitude of the device in meters above sea
+	// level, for the sea level pressure. It overrides the altitude
+	// given for all devices.
+	Altitude *float64 `yaml:"altitude"`
+
+	// Calibration corrects the readings of the device.
+	Calibration Calibration `yaml:"calibration"`
+}
+
+// Calibration holds the corrections of the readings of a device. A nil
+// Correction leaves the reading as is.
+type Calibration struct {
+	// Temperature is corrected in °C.
+	Temperature *Correction `yaml:"temperature"`
+
+	// Humidity is corrected in percent.
+	Humidity *Correction `yaml:"humidity"`
+
+	// Pressure is corrected in hPa.
+	Pressure *Correction `yaml:"pressure"`
+
+	// CO2 is corrected in ppm.
+	CO2 *Correction `yaml:"co2"`
+}
+
+// Correction is a linear correction of a reading: the reading is
+// multiplied by Scale, or 1 if zero, and Offset is added.
+type Correction struct {
+	Offset float64 `yaml:"offset"`
+	Scale  float64 `yaml:"scale"`
+}
+
+// Apply returns the corrected value of v. Apply is safe to call on a
+// nil Correction.
+func (c *Correction) Apply(v float64) float64 {
+	if c == nil {
+		return v
+	}
+	if c.Scale != 0 {
+		v *= c.Scale
+	}
+	return v + c.Offset
+}
+
+// reservedLabels are label names used by the exporter itself that
+// can not be set in the configuration.
+var reservedLabels = map[string]bool{
+	"device":   true,
+	"adapter":  true,
+	"axis":     true,
+	"name":     true,
+	"location": true,
+	"raw":      true,
+	"reason":   true,
+}
+
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Load reads and parses the configuration file at path.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// Parse parses configuration file contents.
+func Parse(data []byte) (*Config, error) {
+	var raw Config
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	// An empty file is a valid configuration without any devices.
+	if err := dec.Decode(&raw); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	filter, err := NewFilter(raw.Allow, raw.Deny)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{
+		Devices: make(map[string]Device, len(raw.Devices)),
+		Allow:   filter.Allow,
+		Deny:    filter.Deny,
+	}
+	for addr, dev := range raw.Devices {
+		if _, err := hci.BtAddressFromString(addr); err != nil {
+			return nil, err
+		}
+		addr = strings.ToLower(addr)
+		if _, ok := cfg.Devices[addr]; ok {
+			return nil, fmt.Errorf("device %s configured more than once", addr)
+		}
+		for name := range dev.Labels {
+			if !labelNameRE.MatchString(name) || strings.HasPrefix(name, "__") {
+				return nil, fmt.Errorf("device %s: invalid label name %q", addr, name)
+			}
+			if reservedLabels[name] {
+				return nil, fmt.Errorf("device %s: label name %q is reserved", addr, name)
+			}
+		}
+		if dev.Expire < 0 {
+			return nil, fmt.Errorf("device %s: negative expire %v", addr, dev.Expire)
+		}
+		for _, c := range []*Correction{dev.Calibration.Temperature, dev.Calibration.Humidity, dev.Calibration.Pressure, dev.Calibration.CO2} {
+			if c != nil && c.Scale < 0 {
+				return nil, fmt.Errorf("device %s: negative calibration scale %v", addr, c.Scale)
+			}
+		}
+		cfg.Devices[addr] = dev
+	}
+	return cfg, nil
+}
+
+// Labels returns the labels configured for the device with MAC address
+// addr, including name and location. Labels with empty value are
+// omitted. Labels is safe to call on a nil Config.
+func (c *Config) Labels(addr string) map[string]string {
+	if c == nil {
+		return nil
+	}
+	dev, ok := c.Devices[addr]
+	if !ok {
+		return nil
+	}
+	labels := make(map[string]string, len(dev.Labels)+2)
+	for name, value := range dev.Labels {
+		if value != "" {
+			labels[name] = value
+		}
+	}
+	if dev.Name != "" {
+		labels["name"] = dev.Name
+	}
+	if dev.Location != "" {
+		labels["location"] = dev.Location
+	}
+	return labels
+}
+
+// Expire returns the expiry duration configured for the device with MAC
+// address addr, or zero if not configured. Expire is safe to call on a
+// nil Config.
+func (c *Config) Expire(addr string) time.Duration {
+	return c.Device(addr).Expire
+}
+
+// Filter returns the allow and deny lists of the configuration. Filter
+// is safe to call on a nil Config.
+func (c *Config) Filter() Filter {
+	if c == nil {
+		return Filter{}
+	}
+	return Filter{Allow: c.Allow, Deny: c.Deny}
+}
+
+// Device returns the settings of the device with MAC address addr, or
+// zero settings if the device is not configured. Device is safe to call
+// on a nil Config.
+func (c *Config) Device(addr string) Device {
+	if c == nil {
+		return Device{}
+	}
+	return c.Devices[addr]
+}
@@ -0,0 +1,141 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+devices:
+  "E7:37:3B:37:D9:74":
+    name: garage
+    location: indoors
+    labels:
+      id: "2"
+  "ee:36:80:be:ec:fd":
+    name: kitchen
+    expire: 15m
+`
+
+func TestParse(t *testing.T) {
+	cfg, err := Parse([]byte(testConfig))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	got := cfg.Labels("e7:37:3b:37:d9:74")
+	want := map[string]string{"name": "garage", "location": "indoors", "id": "2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Labels = %v, expected %v", got, want)
+	}
+	got = cfg.Labels("ee:36:80:be:ec:fd")
+	want = map[string]string{"name": "kitchen"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Labels = %v, expected %v", got, want)
+	}
+	if got := cfg.Labels("00:00:00:00:00:00"); got != nil {
+		t.Errorf("Labels for unconfigured device = %v, expected nil", got)
+	}
+	if got := cfg.Expire("ee:36:80:be:ec:fd"); got != 15*time.Minute {
+		t.Errorf("Expire = %v, expected 15m", got)
+	}
+	if got := cfg.Expire("e7:37:3b:37:d9:74"); got != 0 {
+		t.Errorf("Expire for device without override = %v, expected 0", got)
+	}
+}
+
+func TestParseEmpty(t *testing.T) {
+	cfg, err := Parse(nil)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if len(cfg.Devices) != 0 {
+		t.Errorf("got %d devices, expected none", len(cfg.Devices))
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{"invalid address", "devices:\n  garage:\n    name: x\n", "invalid Bluetooth Address"},
+		{"duplicate address", "devices:\n  aa:bb:cc:dd:ee:ff: {}\n  AA:BB:CC:DD:EE:FF: {}\n", "more than once"},
+		{"invalid label", "devices:\n  aa:bb:cc:dd:ee:ff:\n    labels: {1x: y}\n", "invalid label name"},
+		{"reserved label", "devices:\n  aa:bb:cc:dd:ee:ff:\n    labels: {device: y}\n", "reserved"},
+		{"reserved reason label", "devices:\n  aa:bb:cc:dd:ee:ff:\n    labels: {reason: y}\n", "reserved"},
+		{"negative expire", "devices:\n  aa:bb:cc:dd:ee:ff:\n    expire: -1m\n", "negative expire"},
+		{"negative scale", "devices:\n  aa:bb:cc:dd:ee:ff:\n    calibration:\n      humidity: {scale: -1}\n", "negative calibration scale"},
+		{"unknown field", "devices:\n  aa:bb:cc:dd:ee:ff:\n    nmae: x\n", "not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.config))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Parse error = %v, expected error containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestFilter(t *testing.T) {
+	cfg, err := Parse([]byte(`
+allow:
+  - E7:37:3B
+  - "*:*:*:*:*:fd"
+  - "*:74"
+  - aa:*:cc
+deny:
+  - e7:37:3b:37:d9:74
+`))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"e7:37:3b:00:00:01", true},
+		{"e7:37:3b:37:d9:74", false},
+		{"ee:36:80:be:ec:fd", true},
+		{"ee:36:80:be:ec:fe", false},
+		{"11:74:22:33:44:55", true},
+		{"11:22:74:33:44:55", false},
+		{"aa:bb:cc:00:00:00", true},
+		{"aa:bb:00:cc:00:00", false},
+	}
+	f := cfg.Filter()
+	for _, tt := range tests {
+		if got := f.Allowed(tt.addr); got != tt.want {
+			t.Errorf("Allowed(%s) = %v, expected %v", tt.addr, got, tt.want)
+		}
+	}
+
+	var nilConfig *Config
+	if !nilConfig.Filter().Allowed("e7:37:3b:37:d9:74") {
+		t.Error("empty filter does not allow device")
+	}
+
+	for _, p := range []string{"e7:37:3g", "e7:37:3b:37:d9:74:00", "e7::3b", "e7:[0-9]"} {
+		if _, err := NewFilter([]string{p}, nil); err == nil {
+			t.Errorf("NewFilter(%q): expected error", p)
+		}
+	}
+}
+
+func TestCorrection(t *testing.T) {
+	var none *Correction
+	if got := none.Apply(21.5); got != 21.5 {
+		t.Errorf("nil Apply = %v, expected 21.5", got)
+	}
+	c := &Correction{Offset: -0.5}
+	if got := c.Apply(21.5); got != 21 {
+		t.Errorf("offset Apply = %v, expected 21", got)
+	}
+	c = &Correction{Scale: 1.5, Offset: 1}
+	if got := c.Apply(10); got != 16 {
+		t.Errorf("linear Apply = %v, expected 16", got)
+	}
+}
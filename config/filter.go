@@ -0,0 +1,117 @@
+// Copyright (c) 2018, Joonas Kuorilehto
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package config
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Filter selects devices by MAC address patterns. A pattern is a MAC
+// address, a prefix of whole octets such as "e7:37:3b", or either with
+// the shell wildcards * and ?, e.g. "e7:*:3b:*:*:74".
+type Filter struct {
+	// Allow lists the devices accepted. All devices not denied are
+	// accepted if empty.
+	Allow []string
+
+	// Deny lists the devices dropped, even if allowed.
+	Deny []string
+}
+
+var octetPatternRE = regexp.MustCompile(`^([0-9a-f]{2}|[0-9a-f]?[*?][0-9a-f]?|\*)$`)
+
+// NewFilter returns a Filter with the allow and deny patterns
+// validated and converted to lower case.
+func NewFilter(allow, deny []string) (Filter, error) {
+	var f Filter
+	var err error
+	if f.Allow, err = parsePatterns(allow); err != nil {
+		return Filter{}, err
+	}
+	if f.Deny, err = parsePatterns(deny); err != nil {
+		return Filter{}, err
+	}
+	return f, nil
+}
+
+func parsePatterns(patterns []string) ([]string, error) {
+	var parsed []string
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSpace(p))
+		octets := strings.Split(p, ":")
+		if len(octets) > 6 {
+			return nil, fmt.Errorf("invalid address pattern %q", p)
+		}
+		for _, octet := range octets {
+			if !octetPatternRE.MatchString(octet) {
+				return nil, fmt.Errorf("invalid address pattern %q", p)
+			}
+		}
+		// A prefix matches any remaining octets.
+		for len(octets) < 6 {
+			octets = append(octets, "*")
+		}
+		parsed = append(parsed, strings.Join(octets, ":"))
+	}
+	return parsed, nil
+}
+
+// Allowed reports whether the device with the lower case MAC address
+// addr is accepted by the filter.
+func (f Filter) Allowed(addr string) bool {
+	if matchAny(f.Deny, addr) {
+		return false
+	}
+	return len(f.Allow) == 0 || matchAny(f.Allow, addr)
+}
+
+func matchAny(patterns []string, addr string) bool {
+	for _, p := range patterns {
+		if matchAddress(p, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAddress reports whether addr matches the pattern p octet by
+// octet, so that a wildcard never spans octets.
+func matchAddress(p, addr string) bool {
+	pOctets := strings.Split(p, ":")
+	aOctets := strings.Split(addr, ":")
+	if len(pOctets) != len(aOctets) {
+		return false
+	}
+	for i := range pOctets {
+		// The patterns are validated, so Match can not fail.
+		if ok, _ := path.Match(pOctets[i], aOctets[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
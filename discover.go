@@ -0,0 +1,223 @@
+// Copyright (c) 2018, Joonas Kuorilehto
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/joneskoo/ruuvi-prometheus/bluetooth"
+	"gitlab.com/jtaimisto/bluewalker/host"
+	"gitlab.com/jtaimisto/bluewalker/ruuvi"
+)
+
+// defaultDiscoverDuration is the default duration of the discover
+// subcommand.
+const defaultDiscoverDuration = 30 * time.Second
+
+// discover runs the discover subcommand with args: it scans for the
+// given duration and prints the tags heard. It returns the exit status.
+func discover(args []string) int {
+	fs := flag.NewFlagSet(commandName+" discover", flag.ExitOnError)
+	devices := []string{"hci0"}
+	fs.Var(&deviceFlag{value: &devices}, "device", "HCI device to use; repeat or separate with commas to use multiple adapters")
+	duration := fs.Duration("duration", defaultDiscoverDuration, "Scan for `duration`")
+	snippet := fs.Bool("snippet", false, "Print the tags as a configuration file snippet for naming them")
+	debug := fs.Bool("debug", false, "Debug output")
+	fs.Parse(args)
+	if *duration <= 0 {
+		fmt.Fprintf(os.Stderr, "%s discover: -duration must be positive\n", commandName)
+		return 2
+	}
+	if !*debug {
+		// bluewalker outputs to the global logger.
+		log.SetOutput(ioutil.Discard)
+	}
+
+	d := newDiscovery()
+	var scanners []*bluetooth.Scanner
+	errs := make(chan error, len(devices))
+	var wg sync.WaitGroup
+	for _, device := range devices {
+		device := device
+		scanner := bluetooth.New(bluetooth.ScannerOpts{
+			Device: device,
+			Logger: getDebugLogger(*debug),
+		})
+		scanner.HandleAdvertisement(d.add)
+		scanners = append(scanners, scanner)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := scanner.Scan(); err != nil {
+				errs <- fmt.Errorf("bluetooth scanner %s: %v", device, err)
+			}
+		}()
+	}
+	fmt.Fprintf(os.Stderr, "Scanning for %v...\n", *duration)
+
+	sigint := make(chan os.Signal, 1)
+	signal.Notify(sigint, os.Interrupt)
+	status := 0
+	select {
+	case <-time.After(*duration):
+	case <-sigint:
+	case err := <-errs:
+		fmt.Fprintf(os.Stderr, "%s discover: %v\n", commandName, err)
+		status = 1
+	}
+	for _, scanner := range scanners {
+		scanner.Shutdown()
+	}
+	wg.Wait()
+
+	if *snippet {
+		d.writeConfig(os.Stdout)
+	} else {
+		d.writeTable(os.Stdout)
+	}
+	return status
+}
+
+// discovery aggregates the frames received from each tag.
+type discovery struct {
+	mu   sync.Mutex
+	tags map[string]*discoveredTag
+}
+
+// discoveredTag is the summary of the frames received from a tag.
+type discoveredTag struct {
+	addr    string
+	format  int
+	frames  int
+	rssiMin int
+	rssiMax int
+	rssiSum int
+
+	// temperature is the latest valid temperature, if temperatureValid.
+	temperature      float32
+	temperatureValid bool
+}
+
+func newDiscovery() *discovery {
+	return &discovery{tags: make(map[string]*discoveredTag)}
+}
+
+// add records the Ruuvi frames of the advertisement sr. Frames that
+// fail to decode are ignored.
+func (d *discovery) add(sr *host.ScanReport) {
+	for _, ads := range sr.Data {
+		data, err := ruuvi.Decode(ads.Data)
+		if err != nil {
+			continue
+		}
+		addr := sr.Address.String()
+		rssi := int(sr.Rssi)
+
+		d.mu.Lock()
+		t, ok := d.tags[addr]
+		if !ok {
+			t = &discoveredTag{addr: addr, rssiMin: rssi, rssiMax: rssi}
+			d.tags[addr] = t
+		}
+		t.format = data.DataFormat
+		t.frames++
+		t.rssiSum += rssi
+		if rssi < t.rssiMin {
+			t.rssiMin = rssi
+		}
+		if rssi > t.rssiMax {
+			t.rssiMax = rssi
+		}
+		if data.TemperatureValid() {
+			t.temperature = data.Temperature
+			t.temperatureValid = true
+		}
+		d.mu.Unlock()
+	}
+}
+
+// sorted returns the tags with the strongest average signal, usually
+// the closest, first.
+func (d *discovery) sorted() []discoveredTag {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	tags := make([]discoveredTag, 0, len(d.tags))
+	for _, t := range d.tags {
+		tags = append(tags, *t)
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		ai, aj := tags[i].rssiAvg(), tags[j].rssiAvg()
+		if ai != aj {
+			return ai > aj
+		}
+		return tags[i].addr < tags[j].addr
+	})
+	return tags
+}
+
+func (t discoveredTag) rssiAvg() float64 {
+	return float64(t.rssiSum) / float64(t.frames)
+}
+
+func (t discoveredTag) temperatureString() string {
+	if !t.temperatureValid {
+		return "-"
+	}
+	return fmt.Sprintf("%.2f", t.temperature)
+}
+
+// writeTable writes the tags as a table.
+func (d *discovery) writeTable(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "MAC\tFORMAT\tRSSI MIN\tAVG\tMAX\tFRAMES\tTEMPERATURE\t")
+	for _, t := range d.sorted() {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f\t%d\t%d\t%s\t\n",
+			t.addr, t.format, t.rssiMin, t.rssiAvg(), t.rssiMax, t.frames, t.temperatureString())
+	}
+	tw.Flush()
+}
+
+// writeConfig writes the tags as a configuration file snippet, named
+// after the last two octets of the address as in the Ruuvi app.
+func (d *discovery) writeConfig(w io.Writer) {
+	fmt.Fprintln(w, "devices:")
+	for _, t := range d.sorted() {
+		suffix := strings.ToUpper(strings.ReplaceAll(t.addr[len(t.addr)-5:], ":", ""))
+		fmt.Fprintf(w, "  %q:\n", t.addr)
+		fmt.Fprintf(w, "    # format %d, RSSI %.0f dBm, temperature %s\n", t.format, t.rssiAvg(), t.temperatureString())
+		fmt.Fprintf(w, "    name: \"Ruuvi %s\"\n", suffix)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/joneskoo/ruuvi-prometheus/config"
+	"gitlab.com/jtaimisto/bluewalker/hci"
+	"gitlab.com/jtaimisto/bluewalker/host"
+)
+
+// v6Frame is a Ruuvi Air data format 6 advertisement with temperature
+// 23.795 °C.
+const v6Frame = "990406" + "1297" + "4b7c" + "c625" + "0009" + "0309" +
+	"07" + "00" + "ff" + "ff" + "8d" + "94" + "beecfd"
+
+func scanReport(t *testing.T, addr string, rssi int8, frame string) *host.ScanReport {
+	t.Helper()
+	data, err := hex.DecodeString(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	btaddr, err := hci.BtAddressFromString(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &host.ScanReport{Address: btaddr, Rssi: rssi, Data: []*hci.AdStructure{{Data: data}}}
+}
+
+func TestDiscovery(t *testing.T) {
+	d := newDiscovery()
+	d.add(scanReport(t, "ee:36:80:be:ec:fd", -60, v6Frame))
+	d.add(scanReport(t, "ee:36:80:be:ec:fd", -70, v6Frame))
+	d.add(scanReport(t, "aa:bb:cc:dd:ee:ff", -90, v6Frame))
+	d.add(scanReport(t, "aa:bb:cc:dd:ee:00", -50, "990400"))
+
+	var table bytes.Buffer
+	d.writeTable(&table)
+	lines := strings.Split(strings.TrimSpace(table.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("unexpected table:\n%s", table.String())
+	}
+	if got := strings.Fields(lines[1]); strings.Join(got, " ") != "ee:36:80:be:ec:fd 6 -70 -65.0 -60 2 23.80" {
+		t.Errorf("unexpected row %q", lines[1])
+	}
+
+	var snippet bytes.Buffer
+	d.writeConfig(&snippet)
+	cfg, err := config.Parse(snippet.Bytes())
+	if err != nil {
+		t.Fatalf("snippet does not parse: %v\n%s", err, snippet.String())
+	}
+	if got := cfg.Device("ee:36:80:be:ec:fd").Name; got != "Ruuvi ECFD" {
+		t.Errorf("name %q, expected Ruuvi ECFD", got)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2018, Joonas Kuorilehto
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"sync"
+
+	"github.com/joneskoo/ruuvi-prometheus/config"
+)
+
+// deviceFilter drops the advertisements of devices excluded by the
+// allow and deny lists given on the command line and in the
+// configuration file. A device is accepted if it matches an allow
+// pattern of either, or neither has one, and no deny pattern.
+type deviceFilter struct {
+	flags config.Filter
+
+	// dropped is called for every advertisement dropped, if set.
+	dropped func()
+
+	mu     sync.Mutex
+	filter config.Filter
+}
+
+func newDeviceFilter(flags config.Filter, cfg *config.Config, dropped func()) *deviceFilter {
+	f := &deviceFilter{flags: flags, dropped: dropped}
+	f.SetConfig(cfg)
+	return f
+}
+
+// SetConfig replaces the allow and deny lists of the configuration file.
+func (f *deviceFilter) SetConfig(cfg *config.Config) {
+	c := cfg.Filter()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.filter = config.Filter{
+		Allow: append(append([]string(nil), f.flags.Allow...), c.Allow...),
+		Deny:  append(append([]string(nil), f.flags.Deny...), c.Deny...),
+	}
+}
+
+// Allowed reports whether the advertisements of the device with
+// address addr are accepted. Dropped advertisements are counted.
+func (f *deviceFilter) Allowed(addr string) bool {
+	f.mu.Lock()
+	ok := f.filter.Allowed(addr)
+	f.mu.Unlock()
+	if !ok && f.dropped != nil {
+		f.dropped()
+	}
+	return ok
+}
@@ -0,0 +1,347 @@
+// Copyright (c) 2018, Joonas Kuorilehto
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package influx writes decoded Ruuvi readings in InfluxDB line
+// protocol, either to the InfluxDB write API or to a file.
+package influx
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joneskoo/ruuvi-prometheus/config"
+	"github.com/joneskoo/ruuvi-prometheus/internal/httpwrite"
+	"github.com/joneskoo/ruuvi-prometheus/metrics"
+)
+
+const (
+	// DefaultMeasurement is the default measurement name.
+	DefaultMeasurement = "ruuvi"
+
+	// DefaultFlushInterval is the default interval of writing batches.
+	DefaultFlushInterval = 10 * time.Second
+
+	// DefaultBatchSize is the default number of lines after which a
+	// batch is written before the flush interval.
+	DefaultBatchSize = 500
+
+	// DefaultMaxBuffer is the default number of lines buffered while
+	// the server is unreachable.
+	DefaultMaxBuffer = 100000
+)
+
+// WriterOpts are the options for creating a Writer.
+type WriterOpts struct {
+	// Destination is the InfluxDB write endpoint URL, e.g.
+	// http://localhost:8086/api/v2/write?org=home&bucket=ruuvi, a file
+	// name to append to, or "-" for standard output.
+	Destination string
+
+	// Token is the InfluxDB API token, sent with HTTP requests if set.
+	Token string
+
+	// Measurement is the measurement name, DefaultMeasurement if empty.
+	Measurement string
+
+	// FlushInterval is the interval of writing batches,
+	// DefaultFlushInterval if zero.
+	FlushInterval time.Duration
+
+	// BatchSize is the number of lines after which a batch is written
+	// without waiting for the flush interval, DefaultBatchSize if zero.
+	BatchSize int
+
+	// MaxBuffer is the number of lines kept for retrying while the
+	// server is unreachable, DefaultMaxBuffer if zero. The oldest
+	// lines are dropped when the buffer is full.
+	MaxBuffer int
+
+	// Config is the configuration used for device tags. May be nil.
+	Config *config.Config
+
+	// Client is the HTTP client used. If nil, a client with a timeout
+	// of FlushInterval is used.
+	Client *http.Client
+
+	// Logger receives write errors. May be nil.
+	Logger Logger
+}
+
+// Logger is a log.Logger compatible logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Writer batches readings in InfluxDB line protocol and writes them in
+// the background. Batches that can not be written because the server is
+// unreachable are retried on the next flush.
+type Writer struct {
+	measurement string
+	batchSize   int
+	maxBuffer   int
+	log         Logger
+
+	// write writes a batch of lines. The batch can be retried later if
+	// httpwrite.Retry reports so for the error.
+	write func([]byte) error
+
+	// file is the destination file, closed by Close. Nil for other
+	// destinations.
+	file *os.File
+
+	mu      sync.Mutex
+	cfg     *config.Config
+	lines   []string
+	dropped int
+
+	flush chan struct{}
+	quit  chan struct{}
+	done  chan struct{}
+}
+
+// NewWriter creates a Writer and starts writing in the background.
+func NewWriter(opts WriterOpts) (*Writer, error) {
+	if opts.Measurement == "" {
+		opts.Measurement = DefaultMeasurement
+	}
+	if opts.FlushInterval == 0 {
+		opts.FlushInterval = DefaultFlushInterval
+	}
+	if opts.BatchSize == 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	if opts.MaxBuffer == 0 {
+		opts.MaxBuffer = DefaultMaxBuffer
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: opts.FlushInterval}
+	}
+	if opts.Logger == nil {
+		opts.Logger = log.New(io.Discard, "", 0)
+	}
+
+	w := &Writer{
+		measurement: opts.Measurement,
+		batchSize:   opts.BatchSize,
+		maxBuffer:   opts.MaxBuffer,
+		log:         opts.Logger,
+		cfg:         opts.Config,
+		flush:       make(chan struct{}, 1),
+		quit:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	switch dst := opts.Destination; {
+	case dst == "":
+		return nil, fmt.Errorf("missing InfluxDB destination")
+	case dst == "-":
+		w.write = writeTo(os.Stdout)
+	case strings.HasPrefix(dst, "http://"), strings.HasPrefix(dst, "https://"):
+		w.write = postTo(opts.Client, dst, opts.Token)
+	default:
+		f, err := os.OpenFile(dst, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		w.write = writeTo(f)
+		w.file = f
+	}
+
+	go w.run(opts.FlushInterval)
+	return w, nil
+}
+
+func writeTo(out io.Writer) func([]byte) error {
+	return func(batch []byte) error {
+		_, err := out.Write(batch)
+		return err
+	}
+}
+
+func postTo(client *http.Client, url, token string) func([]byte) error {
+	return func(batch []byte) error {
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(batch))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		if token != "" {
+			req.Header.Set("Authorization", "Token "+token)
+		}
+		if err := httpwrite.Do(client, req); err != nil {
+			return fmt.Errorf("InfluxDB write: %w", err)
+		}
+		return nil
+	}
+}
+
+// SetConfig sets the configuration used for device tags.
+func (w *Writer) SetConfig(c *config.Config) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.cfg = c
+}
+
+// Observe adds the valid readings of o to the batch, timestamped with
+// the time o was received.
+func (w *Writer) Observe(o metrics.RuuviReading) {
+	ts := o.Time
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	line := w.line(o, ts)
+	w.lines = append(w.lines, line)
+	if over := len(w.lines) - w.maxBuffer; over > 0 {
+		w.lines = w.lines[over:]
+		w.dropped += over
+	}
+	if len(w.lines) >= w.batchSize {
+		select {
+		case w.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// line formats o as a line protocol line. w.mu must be held.
+func (w *Writer) line(o metrics.RuuviReading, ts time.Time) string {
+	addr := o.Address.String()
+	var b strings.Builder
+	b.WriteString(escape(w.measurement, ", "))
+
+	tags := w.cfg.Labels(addr)
+	if tags == nil {
+		tags = make(map[string]string)
+	}
+	tags["device"] = addr
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, ",%s=%s", escape(name, ",= "), escape(tags[name], ",= "))
+	}
+
+	fmt.Fprintf(&b, " format=%di", o.DataFormat)
+	for _, f := range o.Fields() {
+		fmt.Fprintf(&b, ",%s=%s", escape(f.Name, ",= "), f.FormatValue())
+	}
+	fmt.Fprintf(&b, " %d\n", ts.UnixNano())
+	return b.String()
+}
+
+// escape escapes backslashes and the characters in special with a
+// backslash.
+func escape(s, special string) string {
+	if !strings.ContainsAny(s, special+`\`) {
+		return s
+	}
+	var b strings.Builder
+	for _, r := range s {
+		if r == '\\' || strings.ContainsRune(special, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Close writes the buffered readings, stops the background writer and
+// closes the destination if it is a file.
+func (w *Writer) Close() {
+	close(w.quit)
+	<-w.done
+	if w.file != nil {
+		if err := w.file.Close(); err != nil {
+			w.log.Printf("InfluxDB file: %v", err)
+		}
+	}
+}
+
+func (w *Writer) run(interval time.Duration) {
+	defer close(w.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.flush:
+		case <-w.quit:
+			w.writeBuffered()
+			return
+		}
+		w.writeBuffered()
+	}
+}
+
+// writeBuffered writes the buffered lines in batches. Lines are kept
+// for retrying if a batch fails with a retryable error.
+func (w *Writer) writeBuffered() {
+	for {
+		w.mu.Lock()
+		if w.dropped > 0 {
+			w.log.Printf("InfluxDB buffer full, dropped %d oldest lines", w.dropped)
+			w.dropped = 0
+		}
+		n := len(w.lines)
+		if n > w.batchSize {
+			n = w.batchSize
+		}
+		batch := strings.Join(w.lines[:n], "")
+		w.mu.Unlock()
+		if n == 0 {
+			return
+		}
+
+		err := w.write([]byte(batch))
+		if httpwrite.Retry(err) {
+			w.log.Printf("%v; retrying later", err)
+			return
+		}
+		if err != nil {
+			w.log.Printf("%v; dropping %d lines", err, n)
+		}
+
+		w.mu.Lock()
+		// Lines dropped for buffer overflow during the write shift
+		// the written lines towards the start.
+		written := n - w.dropped
+		if written < 0 {
+			written = 0
+		}
+		w.lines = w.lines[written:]
+		w.mu.Unlock()
+	}
+}
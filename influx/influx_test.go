@@ -0,0 +1,203 @@
+package influx
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/joneskoo/ruuvi-prometheus/config"
+	"github.com/joneskoo/ruuvi-prometheus/metrics"
+	"gitlab.com/jtaimisto/bluewalker/hci"
+	"gitlab.com/jtaimisto/bluewalker/host"
+	"gitlab.com/jtaimisto/bluewalker/ruuvi"
+)
+
+const testAddr = "ee:36:80:be:ec:fd"
+
+// v5Frame is a Ruuvi data format 5 advertisement from the format
+// specification test vectors.
+const v5Frame = "99040512FC5394C37C0004FFFC040CAC364200CDCBB8334C884F"
+
+func reading(t *testing.T) metrics.RuuviReading {
+	t.Helper()
+	data, err := hex.DecodeString(v5Frame)
+	if err != nil {
+		t.Fatalf("invalid frame hex: %v", err)
+	}
+	decoded, err := ruuvi.Decode(data)
+	if err != nil {
+		t.Fatalf("unable to decode frame: %v", err)
+	}
+	addr, err := hci.BtAddressFromString(testAddr)
+	if err != nil {
+		t.Fatalf("invalid address: %v", err)
+	}
+	return metrics.RuuviReading{
+		ScanReport: &host.ScanReport{Address: addr, Rssi: -60},
+		Data:       decoded,
+	}
+}
+
+func TestLine(t *testing.T) {
+	cfg, err := config.Parse([]byte(`
+devices:
+  EE:36:80:BE:EC:FD:
+    name: living room
+    labels:
+      floor: "1"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &Writer{measurement: "ruuvi", cfg: cfg}
+	got := w.line(reading(t), time.Unix(1700000000, 5))
+
+	want := `ruuvi,device=ee:36:80:be:ec:fd,floor=1,name=living\ room format=5i,` +
+		`temperature=24.3,humidity=53.489998,pressure=1000.44,battery=2.977,` +
+		`acceleration_x=0.004,acceleration_y=-0.004,acceleration_z=1.036,` +
+		`tx_power=4,movement_counter=66,sequence=205 1700000000000000005` + "\n"
+	if got != want {
+		t.Errorf("line:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestEscape(t *testing.T) {
+	for in, want := range map[string]string{
+		"plain":     "plain",
+		"a b,c=d":   `a\ b\,c\=d`,
+		`back\sl`:   `back\\sl`,
+		"unicode ä": `unicode\ ä`,
+	} {
+		if got := escape(in, ",= "); got != want {
+			t.Errorf("escape(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// TestRetry checks that batches are kept and written again after the
+// server has failed.
+func TestRetry(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		failures = 1
+		bodies   []string
+		auth     string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		auth = r.Header.Get("Authorization")
+		if failures > 0 {
+			failures--
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	w, err := NewWriter(WriterOpts{
+		Destination:   srv.URL + "/api/v2/write?org=home&bucket=ruuvi",
+		Token:         "secret",
+		FlushInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Observe(reading(t))
+	w.Observe(reading(t))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(bodies)
+		mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for write")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	w.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if auth != "Token secret" {
+		t.Errorf("Authorization = %q", auth)
+	}
+	lines := strings.Count(strings.Join(bodies, ""), "\n")
+	if lines != 2 {
+		t.Errorf("wrote %d lines, want 2: %q", lines, bodies)
+	}
+}
+
+// TestBadRequest checks that batches rejected by the server are dropped.
+func TestBadRequest(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		http.Error(w, "bad", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	w, err := NewWriter(WriterOpts{Destination: srv.URL, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Observe(reading(t))
+	w.writeBuffered()
+	w.writeBuffered()
+	w.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 1 {
+		t.Errorf("%d requests, want 1", requests)
+	}
+}
+
+func TestBufferLimit(t *testing.T) {
+	w := &Writer{measurement: "ruuvi", batchSize: 100, maxBuffer: 2, flush: make(chan struct{}, 1)}
+	for i := 0; i < 5; i++ {
+		w.Observe(reading(t))
+	}
+	if len(w.lines) != 2 || w.dropped != 3 {
+		t.Errorf("buffered %d lines, dropped %d; want 2 and 3", len(w.lines), w.dropped)
+	}
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ruuvi.lp")
+	w, err := NewWriter(WriterOpts{Destination: path, Measurement: "env"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Observe(reading(t))
+	w.Close()
+	if err := w.write(nil); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("write after Close: %v, expected file closed", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "env,device=ee:36:80:be:ec:fd format=5i,temperature=24.3,") {
+		t.Errorf("unexpected file content %q", data)
+	}
+}
@@ -0,0 +1,36 @@
+package httpwrite
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDo(t *testing.T) {
+	tests := []struct {
+		status     int
+		err, retry bool
+	}{
+		{http.StatusNoContent, false, false},
+		{http.StatusBadRequest, true, false},
+		{http.StatusTooManyRequests, true, true},
+		{http.StatusServiceUnavailable, true, true},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "failed", tt.status)
+		}))
+		req, _ := http.NewRequest(http.MethodPost, srv.URL, nil)
+		err := Do(http.DefaultClient, req)
+		srv.Close()
+		if (err != nil) != tt.err || Retry(err) != tt.retry {
+			t.Errorf("status %d: error %v, retry %v", tt.status, err, Retry(err))
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1:1", nil)
+	if err := Do(http.DefaultClient, req); !Retry(fmt.Errorf("wrapped: %w", err)) {
+		t.Errorf("unreachable server: %v, expected retry", err)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2018, Joonas Kuorilehto
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DeviceStatus is the current state of a device.
+type DeviceStatus struct {
+	Device   string            `json:"device"`
+	Name     string            `json:"name,omitempty"`
+	Location string            `json:"location,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+
+	// Up is false for an expired device kept with KeepExpired.
+	Up bool `json:"up"`
+
+	// Format is the data format of the latest measurement.
+	Format int `json:"format"`
+
+	LastSeen time.Time `json:"last_seen"`
+	Measured time.Time `json:"measured"`
+
+	// Frames excludes frames received by more than one adapter.
+	Frames       int `json:"frames"`
+	Measurements int `json:"measurements"`
+	SeqnoGaps    int `json:"seqno_gaps"`
+
+	Adapters map[string]AdapterStatus `json:"adapters"`
+
+	// Readings are the valid readings of the latest measurement by
+	// field name, in the units of Field.
+	Readings map[string]float64 `json:"readings"`
+}
+
+// AdapterStatus is the state of a device as received by one adapter.
+type AdapterStatus struct {
+	RSSI     int       `json:"rssi"`
+	Frames   int       `json:"frames"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// Devices returns the status of the devices, sorted by address.
+func (e *Exporter) Devices() []DeviceStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	devices := make([]DeviceStatus, 0, len(e.devices))
+	for addr := range e.devices {
+		devices = append(devices, e.deviceStatus(addr))
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Device < devices[j].Device })
+	return devices
+}
+
+// Device returns the status of the device with address addr, or false
+// if the device has not been seen or has been removed on expiry. An
+// expired device kept with KeepExpired is returned with Up false.
+func (e *Exporter) Device(addr string) (DeviceStatus, bool) {
+	addr = strings.ToLower(addr)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.devices[addr]; !ok {
+		return DeviceStatus{}, false
+	}
+	return e.deviceStatus(addr), true
+}
+
+// deviceStatus returns the status of a known device. e.mu must be held.
+func (e *Exporter) deviceStatus(addr string) DeviceStatus {
+	d := e.devices[addr]
+	cfg := e.cfg.Device(addr)
+	s := DeviceStatus{
+		Device:       addr,
+		Name:         cfg.Name,
+		Location:     cfg.Location,
+		Labels:       copyLabels(cfg.Labels),
+		Up:           !d.expired,
+		LastSeen:     d.lastSeen,
+		Measured:     d.measured,
+		Frames:       d.frames,
+		Measurements: d.measurements,
+		SeqnoGaps:    d.gaps,
+		Adapters:     make(map[string]AdapterStatus, len(d.adapters)),
+		Readings:     make(map[string]float64),
+	}
+	for name, a := range d.adapters {
+		s.Adapters[name] = AdapterStatus{RSSI: a.rssi, Frames: a.frames, LastSeen: a.lastSeen}
+	}
+	if d.reading.Data != nil {
+		s.Format = d.reading.DataFormat
+		for _, f := range d.reading.Fields() {
+			s.Readings[f.Name] = f.Value
+		}
+	}
+	return s
+}
+
+// copyLabels returns a copy of labels, so that the configuration can
+// not be modified through the status.
+func copyLabels(labels map[string]string) map[string]string {
+	if labels == nil {
+		return nil
+	}
+	c := make(map[string]string, len(labels))
+	for name, value := range labels {
+		c[name] = value
+	}
+	return c
+}
+
+func (e *Exporter) handleDevices(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, e.Devices())
+}
+
+func (e *Exporter) handleDevice(w http.ResponseWriter, r *http.Request) {
+	addr := strings.TrimPrefix(r.URL.Path, "/api/devices/")
+	device, ok := e.Device(addr)
+	if !ok {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, device)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
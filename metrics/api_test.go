@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/joneskoo/ruuvi-prometheus/config"
+)
+
+func TestAPI(t *testing.T) {
+	cfg, err := config.Parse([]byte(`
+devices:
+  EE:36:80:BE:EC:FD:
+    name: office
+    labels:
+      floor: "2"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := New(ExporterOpts{Config: cfg})
+	defer e.Close()
+	o := reading(t, testAddr, v6Frame)
+	o.Adapter = "hci0"
+	e.Observe(o)
+	o.Adapter = "hci1"
+	e.Observe(o)
+
+	srv := httptest.NewServer(e.Handler())
+	defer srv.Close()
+
+	var devices []DeviceStatus
+	get(t, srv.URL+"/api/devices", http.StatusOK, &devices)
+	if len(devices) != 1 {
+		t.Fatalf("got %d devices, expected 1", len(devices))
+	}
+
+	var d DeviceStatus
+	get(t, srv.URL+"/api/devices/EE:36:80:BE:EC:FD", http.StatusOK, &d)
+	if d.Device != testAddr || d.Name != "office" || d.Labels["floor"] != "2" || !d.Up {
+		t.Errorf("unexpected device %+v", d)
+	}
+	if d.Format != 6 || d.Frames != 1 || d.Measurements != 1 {
+		t.Errorf("format %d, frames %d, measurements %d; expected 6, 1, 1", d.Format, d.Frames, d.Measurements)
+	}
+	if len(d.Adapters) != 2 || d.Adapters["hci1"].RSSI != -60 || d.Adapters["hci1"].Frames != 1 {
+		t.Errorf("unexpected adapters %+v", d.Adapters)
+	}
+	if d.Readings["co2"] != 777 {
+		t.Errorf("co2 %v, expected 777", d.Readings["co2"])
+	}
+
+	get(t, srv.URL+"/api/devices/00:00:00:00:00:00", http.StatusNotFound, nil)
+
+	// The labels returned can not modify the configuration.
+	d, _ = e.Device(testAddr)
+	d.Labels["floor"] = "3"
+	if got := cfg.Labels(testAddr)["floor"]; got != "2" {
+		t.Errorf("configured floor label %q after modifying status, expected 2", got)
+	}
+}
+
+func get(t *testing.T, url string, status int, v interface{}) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != status {
+		t.Fatalf("GET %s: status %d, expected %d", url, resp.StatusCode, status)
+	}
+	if v == nil {
+		return
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2018, Joonas Kuorilehto
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package metrics
+
+// batterySamples is the number of measurements the smoothed battery
+// voltage is averaged over.
+const batterySamples = 10
+
+// batteryLowVolts returns the voltage below which the battery is low at
+// temperature t in °C. The CR2477 voltage drops in the cold, so the
+// thresholds are those of the Ruuvi Station app: 2.0 V at -20 °C and
+// below, 2.3 V below 0 °C and 2.5 V otherwise.
+func batteryLowVolts(t float64) float64 {
+	switch {
+	case t <= -20:
+		return 2.0
+	case t < 0:
+		return 2.3
+	default:
+		return 2.5
+	}
+}
+
+// batteryState holds the latest battery voltages of a device.
+type batteryState struct {
+	samples []float64
+	next    int
+}
+
+// add records the voltage v and returns the average of the latest
+// batterySamples voltages.
+func (b *batteryState) add(v float64) float64 {
+	if len(b.samples) < batterySamples {
+		b.samples = append(b.samples, v)
+	} else {
+		b.samples[b.next] = v
+		b.next = (b.next + 1) % batterySamples
+	}
+	sum := 0.0
+	for _, s := range b.samples {
+		sum += s
+	}
+	return sum / float64(len(b.samples))
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// v5Frame returns a data format 5 advertisement with the temperature in
+// units of 0.005 °C, the battery voltage in mV and sequence number
+// seqno.
+func v5Frame(temperature int16, millivolts int, seqno uint16) string {
+	power := (millivolts-1600)<<5 | 22
+	return "990405" + fmt.Sprintf("%04x", uint16(temperature)) + "5394c37c0004fffc040c" +
+		fmt.Sprintf("%04x", power) + "42" + fmt.Sprintf("%04x", seqno) + "cbb8334c884f"
+}
+
+func TestBattery(t *testing.T) {
+	volts := func(e *Exporter) (float64, float64, float64) {
+		return testutil.ToFloat64(e.voltage.WithLabelValues(testAddr)),
+			testutil.ToFloat64(e.voltageAvg.WithLabelValues(testAddr)),
+			testutil.ToFloat64(e.batteryLow.WithLabelValues(testAddr))
+	}
+
+	e := New(ExporterOpts{})
+	defer e.Close()
+
+	// 2.4 V is low at room temperature but not at -10 °C.
+	e.Observe(reading(t, testAddr, v5Frame(-2000, 2400, 1)))
+	if v, avg, low := volts(e); v != 2.4 || avg != 2.4 || low != 0 {
+		t.Errorf("cold: voltage %v, smoothed %v, low %v; expected 2.4, 2.4, 0", v, avg, low)
+	}
+	e.Observe(reading(t, testAddr, v5Frame(4000, 2400, 2)))
+	if _, _, low := volts(e); low != 1 {
+		t.Errorf("warm: low %v, expected 1", low)
+	}
+
+	// A single dip does not bring the smoothed voltage below the
+	// threshold.
+	e = New(ExporterOpts{})
+	defer e.Close()
+	for i := 0; i < batterySamples; i++ {
+		e.Observe(reading(t, testAddr, v5Frame(4000, 3000, uint16(i))))
+	}
+	e.Observe(reading(t, testAddr, v5Frame(4000, 2000, batterySamples)))
+	if v, avg, low := volts(e); v != 2 || math.Abs(avg-2.9) > 1e-9 || low != 0 {
+		t.Errorf("dip: voltage %v, smoothed %v, low %v; expected 2, 2.9, 0", v, avg, low)
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2018, Joonas Kuorilehto
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package metrics
+
+import (
+	"math"
+
+	"github.com/joneskoo/ruuvi-prometheus/config"
+)
+
+// calibrate returns o with the corrections of c applied and the
+// uncorrected data in Raw. The data of o is copied, not modified.
+// Readings that are not valid are left as is.
+func calibrate(o RuuviReading, c config.Calibration) RuuviReading {
+	if c == (config.Calibration{}) || o.Data == nil {
+		return o
+	}
+	data := *o.Data
+	if data.TemperatureValid() {
+		data.Temperature = float32(c.Temperature.Apply(float64(data.Temperature)))
+	}
+	if data.HumidityValid() {
+		rh := c.Humidity.Apply(float64(data.Humidity))
+		data.Humidity = float32(math.Max(0, math.Min(100, rh)))
+	}
+	if data.PressureValid() {
+		data.Pressure = int(math.Round(c.Pressure.Apply(float64(data.Pressure)/100) * 100))
+	}
+	if data.CO2Valid() {
+		data.CO2 = int(math.Round(c.CO2.Apply(float64(data.CO2))))
+	}
+	o.Raw = o.Data
+	o.Data = &data
+	return o
+}
@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/joneskoo/ruuvi-prometheus/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCalibration(t *testing.T) {
+	cfg, err := config.Parse([]byte(`
+devices:
+  ee:36:80:be:ec:fd:
+    name: office
+    calibration:
+      temperature: {offset: -0.5}
+      humidity: {scale: 2}
+      co2: {scale: 1.1, offset: -50}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := New(ExporterOpts{Config: cfg, ExportRaw: true})
+	defer e.Close()
+	o, _ := e.Observe(reading(t, testAddr, v6Frame))
+	if o.CO2 != 805 || o.Raw == nil || o.Raw.CO2 != 777 {
+		t.Errorf("returned co2 %v, expected corrected 805 with raw 777", o.CO2)
+	}
+
+	expected := `
+# HELP ruuvi_co2_ppm Ruuvi sensor CO2 concentration
+# TYPE ruuvi_co2_ppm gauge
+ruuvi_co2_ppm{device="ee:36:80:be:ec:fd",name="office"} 805
+ruuvi_co2_ppm{device="ee:36:80:be:ec:fd",name="office",raw="true"} 777
+# HELP ruuvi_humidity_ratio Ruuvi tag sensor relative humidity
+# TYPE ruuvi_humidity_ratio gauge
+ruuvi_humidity_ratio{device="ee:36:80:be:ec:fd",name="office"} 0.966199951171875
+ruuvi_humidity_ratio{device="ee:36:80:be:ec:fd",name="office",raw="true"} 0.4830999755859375
+# HELP ruuvi_pressure_hpa Ruuvi tag sensor air pressure
+# TYPE ruuvi_pressure_hpa gauge
+ruuvi_pressure_hpa{device="ee:36:80:be:ec:fd",name="office"} 1007.25
+# HELP ruuvi_temperature_celsius Ruuvi tag sensor temperature
+# TYPE ruuvi_temperature_celsius gauge
+ruuvi_temperature_celsius{device="ee:36:80:be:ec:fd",name="office"} 23.295000076293945
+ruuvi_temperature_celsius{device="ee:36:80:be:ec:fd",name="office",raw="true"} 23.795000076293945
+`
+	err = testutil.GatherAndCompare(e.Gatherer(), strings.NewReader(expected),
+		"ruuvi_co2_ppm", "ruuvi_humidity_ratio", "ruuvi_pressure_hpa", "ruuvi_temperature_celsius")
+	if err != nil {
+		t.Error(err)
+	}
+
+	d, _ := e.Device(testAddr)
+	if d.Readings["co2"] != 805 {
+		t.Errorf("API co2 %v, expected corrected 805", d.Readings["co2"])
+	}
+}
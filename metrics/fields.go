@@ -0,0 +1,105 @@
+// Copyright (c) 2018, Joonas Kuorilehto
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package metrics
+
+import "strconv"
+
+// Field is a single sensor reading of a RuuviReading.
+type Field struct {
+	// Name identifies the reading, e.g. "temperature".
+	Name string
+
+	// Unit is the unit of Value, empty for dimensionless readings.
+	Unit string
+
+	Value float64
+}
+
+// FormatValue formats the value with the shortest representation of its
+// single precision value, as most readings are decoded as float32.
+func (f Field) FormatValue() string {
+	return strconv.FormatFloat(f.Value, 'f', -1, 32)
+}
+
+// Fields returns the readings of o that the data format reports valid,
+// in the same order for every reading. As in Exporter.Observe, air
+// quality readings are left out while the sensor is calibrating.
+//
+// Unlike the Prometheus metrics, humidity is in percent rather than a
+// ratio, as consumers of the fields expect.
+func (o RuuviReading) Fields() []Field {
+	var fields []Field
+	add := func(name, unit string, value float64) {
+		fields = append(fields, Field{Name: name, Unit: unit, Value: value})
+	}
+
+	if o.TemperatureValid() {
+		add("temperature", "°C", float64(o.Temperature))
+	}
+	if o.HumidityValid() {
+		add("humidity", "%", float64(o.Humidity))
+	}
+	if o.PressureValid() {
+		add("pressure", "hPa", float64(o.Pressure)/100)
+	}
+	if o.VoltageValid() {
+		add("battery", "V", float64(o.Voltage)/1000)
+	}
+	if o.AccelerationValid() {
+		add("acceleration_x", "g", float64(o.AccelerationX))
+		add("acceleration_y", "g", float64(o.AccelerationY))
+		add("acceleration_z", "g", float64(o.AccelerationZ))
+	}
+	if o.TxPowerValid() {
+		add("tx_power", "dBm", float64(o.TxPower))
+	}
+	if o.MoveCountValid() {
+		add("movement_counter", "", float64(o.MoveCount))
+	}
+	if o.SeqnoValid() {
+		add("sequence", "", float64(o.Seqno))
+	}
+	if o.LuminosityValid() {
+		add("luminosity", "lx", float64(o.Luminosity))
+	}
+	if o.SoundAvgValid() {
+		add("sound_avg", "dBA", float64(o.SoundAvg))
+	}
+	if !o.Calibrating {
+		if o.PM25Valid() {
+			add("pm25", "µg/m³", float64(o.PM25))
+		}
+		if o.CO2Valid() {
+			add("co2", "ppm", float64(o.CO2))
+		}
+		if o.VOCIndexValid() {
+			add("voc", "", float64(o.VOCIndex))
+		}
+		if o.NOXIndexValid() {
+			add("nox", "", float64(o.NOXIndex))
+		}
+	}
+	return fields
+}
@@ -30,26 +30,16 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-var Handler = http.NewServeMux()
-
-func init() {
-	Handler.HandleFunc("/", handleRoot)
-	Handler.Handle("/metrics", promhttp.Handler())
-}
-
-const rootContent = `ruuvi-prometheus exporter
-https://github.com/joneskoo/ruuvi-prometheus
-
-/                This page
-/metrics         Prometheus metrics endpoint
-`
-
-func handleRoot(w http.ResponseWriter, r *http.Request) {
-	if r.RequestURI != "/" {
-		http.NotFound(w, r)
-		return
-	}
-	w.Header().Set("Content-Type", "text/plain")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(rootContent))
+// Handler returns the HTTP handler serving the exporter pages and the
+// Prometheus metrics endpoint.
+func (e *Exporter) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", e.handleRoot)
+	mux.HandleFunc("/api/devices", e.handleDevices)
+	mux.HandleFunc("/api/devices/", e.handleDevice)
+	mux.HandleFunc("/api/stream", e.handleStream)
+	mux.Handle("/metrics", promhttp.InstrumentMetricHandler(
+		e.registry, promhttp.HandlerFor(e.registry, promhttp.HandlerOpts{}),
+	))
+	return mux
 }
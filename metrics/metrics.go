@@ -25,220 +25,1079 @@
 package metrics
 
 import (
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/joneskoo/ruuvi-prometheus/config"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
 	"gitlab.com/jtaimisto/bluewalker/host"
 	"gitlab.com/jtaimisto/bluewalker/ruuvi"
 )
 
-var (
-	ruuviFrames = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "ruuvi_frames_total",
-		Help: "Total Ruuvi frames received",
+const (
+	// DefaultNamespace is the default prefix of the metric names.
+	DefaultNamespace = "ruuvi"
+
+	// DefaultTTL is the default duration after which sensors are
+	// forgotten if signal is lost.
+	DefaultTTL = 1 * time.Minute
+
+	// expireInterval is the interval of checking for expired devices.
+	expireInterval = 10 * time.Second
+
+	// dedupWindow is the number of latest measurements of a device
+	// remembered for detecting the same transmission received by more
+	// than one adapter.
+	dedupWindow = 8
+
+	// maxReorder is the number of measurements a frame can be behind
+	// the latest one and be considered received late rather than from
+	// a restarted tag.
+	maxReorder = 8
+
+	// minMeasurementInterval is the shortest interval at which tags
+	// make measurements, for telling a restart from the sequence
+	// number wrapping around.
+	minMeasurementInterval = 100 * time.Millisecond
+)
+
+// ExporterOpts are the options for creating an Exporter.
+type ExporterOpts struct {
+	// Namespace is the prefix of the metric names, DefaultNamespace
+	// if empty.
+	Namespace string
+
+	// TTL is the duration after which sensors are forgotten if signal
+	// is lost, DefaultTTL if zero. It can be overridden per device in
+	// the configuration.
+	TTL time.Duration
+
+	// KeepExpired keeps the series of expired devices, marking them
+	// down with ruuvi_up 0, instead of removing them.
+	KeepExpired bool
+
+	// Config is the configuration used for device labels. May be nil.
+	Config *config.Config
+
+	// OnExpire is called with the device address when a device
+	// expires, if set.
+	OnExpire func(device string)
+
+	// Timestamps exports the device gauges with the time the
+	// underlying advertisement was received instead of the scrape time.
+	Timestamps bool
+
+	// Altitude is the altitude of the devices in meters above sea
+	// level for ruuvi_pressure_sea_level_hpa, if not nil. It can be
+	// overridden per device in the configuration.
+	Altitude *float64
+
+	// ExportRaw also exports the uncorrected readings of the devices
+	// with calibration configured, labeled raw="true".
+	ExportRaw bool
+}
+
+// Exporter exports Ruuvi readings as Prometheus metrics.
+type Exporter struct {
+	ttl         time.Duration
+	keepExpired bool
+	onExpire    func(device string)
+	timestamps  bool
+	exportRaw   bool
+	altitude    *float64
+
+	// upName and lastSeenName are the fully qualified names of the
+	// gauges that are not timestamped with the measurement time.
+	upName       string
+	lastSeenName string
+
+	quit      chan struct{}
+	quitOnce  sync.Once
+	cleanDone chan struct{}
+
+	// registry is exposed by Handler. It includes the device metrics
+	// from devices through deviceCollector.
+	registry *prometheus.Registry
+
+	// deviceMetrics holds the device metrics. They are exported
+	// through deviceCollector, which adds the labels configured for
+	// each device.
+	deviceMetrics *prometheus.Registry
+
+	// rawMetrics holds the uncorrected readings exported with
+	// ExportRaw. They share the names of the corrected readings in
+	// deviceMetrics, with the additional raw label.
+	rawMetrics *prometheus.Registry
+
+	ruuviFrames   *prometheus.CounterVec
+	adapterFrames *prometheus.CounterVec
+	measurements  *prometheus.CounterVec
+	seqnoGaps     *prometheus.CounterVec
+	filtered      prometheus.Counter
+	decodeErrors  *prometheus.CounterVec
+	unknownFormat *prometheus.CounterVec
+	lastSeen      *prometheus.GaugeVec
+	up            *prometheus.GaugeVec
+	humidity      *prometheus.GaugeVec
+	temperature   *prometheus.GaugeVec
+	pressure      *prometheus.GaugeVec
+	seaPressure   *prometheus.GaugeVec
+	dewPoint      *prometheus.GaugeVec
+	absHumidity   *prometheus.GaugeVec
+	vpd           *prometheus.GaugeVec
+	acceleration  *prometheus.GaugeVec
+	voltage       *prometheus.GaugeVec
+	voltageAvg    *prometheus.GaugeVec
+	batteryLow    *prometheus.GaugeVec
+	signalRSSI    *prometheus.GaugeVec
+	format        *prometheus.GaugeVec
+	txPower       *prometheus.GaugeVec
+	moveCount     *prometheus.GaugeVec
+	movements     *prometheus.CounterVec
+	accelMag      *prometheus.GaugeVec
+	tilt          *prometheus.GaugeVec
+	seqno         *prometheus.GaugeVec
+	pm25          *prometheus.GaugeVec
+	co2           *prometheus.GaugeVec
+	vocIndex      *prometheus.GaugeVec
+	noxIndex      *prometheus.GaugeVec
+	luminosity    *prometheus.GaugeVec
+	soundAvg      *prometheus.GaugeVec
+	calibrating   *prometheus.GaugeVec
+
+	rawTemperature *prometheus.GaugeVec
+	rawHumidity    *prometheus.GaugeVec
+	rawPressure    *prometheus.GaugeVec
+	rawCO2         *prometheus.GaugeVec
+
+	// deviceVecs lists every metric vector with a device label, so that
+	// all series of an expired device can be removed without
+	// maintaining a per-metric list.
+	deviceVecs []interface {
+		DeletePartialMatch(prometheus.Labels) int
+	}
+
+	mu      sync.Mutex
+	devices map[string]*deviceState
+	cfg     *config.Config
+
+	// decodeErrorSeen is the time of the last decode error of each
+	// device, so that the series of devices sending only frames that
+	// fail to decode expire too.
+	decodeErrorSeen map[string]time.Time
+
+	// streamMu protects the subscribers of the live stream.
+	streamMu    sync.Mutex
+	subscribers map[*subscriber]bool
+	streamID    uint64
+
+	// streamsEnd is closed by EndStreams to end the live streams.
+	streamsEnd     chan struct{}
+	streamsEndOnce sync.Once
+}
+
+// deviceState is the state kept for each device seen.
+type deviceState struct {
+	lastSeen time.Time
+	expired  bool
+
+	// observed is the local time the latest frame was observed, for
+	// expiry. It differs from lastSeen when replaying a capture.
+	observed time.Time
+
+	// measured is the time the latest measurement was received and
+	// reading the latest measurement.
+	measured time.Time
+	reading  RuuviReading
+
+	// frames, measurements and gaps count the frames received,
+	// duplicates excluded, the measurements and the measurements
+	// missed.
+	frames       int
+	measurements int
+	gaps         int
+
+	// moveCount is the latest movement counter value, if moveValid.
+	moveCount int
+	moveValid bool
+
+	// battery holds the latest battery voltages for smoothing.
+	battery batteryState
+
+	// adapters is the state of the device per receiving adapter.
+	adapters map[string]*adapterState
+
+	// seqno and format are the sequence number and data format of the
+	// latest measurement, if the sequence number is valid.
+	seqno      int
+	format     int
+	seqnoValid bool
+
+	// recent are the latest measurements, oldest first, with the
+	// adapters that have received them. A frame with the same sequence
+	// number from another adapter is the same transmission received
+	// twice, even if it arrives after a later measurement.
+	recent []recentFrame
+}
+
+// recentFrame is a recently received measurement.
+type recentFrame struct {
+	seqno   int
+	heardBy map[string]bool
+}
+
+// adapterState is the state kept for each adapter receiving a device.
+type adapterState struct {
+	lastSeen time.Time
+	rssi     int
+	frames   int
+}
+
+// frameInfo classifies a received frame.
+type frameInfo struct {
+	// duplicate is true for a transmission already received by
+	// another adapter.
+	duplicate bool
+
+	// measurement is true if the frame carries a new measurement
+	// rather than repeats the previous one.
+	measurement bool
+
+	// gaps is the number of measurements missed before this one.
+	gaps int
+
+	// restarted is true if the sequence number started again, meaning
+	// the tag restarted.
+	restarted bool
+}
+
+// update records that the frame o was received at now. Frames without
+// a valid sequence number are always new measurements.
+func (d *deviceState) update(o RuuviReading, now time.Time) frameInfo {
+	if !o.SeqnoValid() {
+		d.seqnoValid = false
+		return frameInfo{measurement: true}
+	}
+	sameFormat := d.seqnoValid && d.format == o.DataFormat
+	if !sameFormat {
+		d.recent = nil
+	}
+	for i, r := range d.recent {
+		if r.seqno != o.Seqno {
+			continue
+		}
+		if !r.heardBy[o.Adapter] {
+			r.heardBy[o.Adapter] = true
+			return frameInfo{duplicate: true}
+		}
+		// Repeated transmission of the same measurement.
+		d.recent[i].heardBy = map[string]bool{o.Adapter: true}
+		return frameInfo{}
+	}
+
+	info := frameInfo{measurement: true}
+	if sameFormat {
+		diff, modulus := seqnoDiff(d.seqno, o.Seqno, o.DataFormat)
+		switch {
+		case diff > modulus-maxReorder:
+			// A measurement received late, after a later one, is
+			// older than the state.
+			return frameInfo{}
+		case diff > modulus/2:
+			info.restarted = true
+		case o.Seqno < d.seqno && diff > maxSeqnoJump(now.Sub(d.measured)):
+			// The sequence number wrapped around faster than the
+			// tag can measure, so it restarted from zero.
+			info.restarted = true
+		default:
+			info.gaps = seqnoGaps(d.seqno, o.Seqno, o.DataFormat)
+		}
+	}
+	d.seqno = o.Seqno
+	d.format = o.DataFormat
+	d.seqnoValid = true
+	d.recent = append(d.recent, recentFrame{seqno: o.Seqno, heardBy: map[string]bool{o.Adapter: true}})
+	if len(d.recent) > dedupWindow {
+		d.recent = d.recent[1:]
+	}
+	return info
+}
+
+// seqnoGaps returns the number of measurements missed between sequence
+// numbers prev and next. A jump backwards, meaning the tag restarted or
+// frames arrived out of order, is not counted as missed measurements.
+func seqnoGaps(prev, next, format int) int {
+	diff, modulus := seqnoDiff(prev, next, format)
+	if diff == 0 || diff > modulus/2 {
+		return 0
+	}
+	return diff - 1
+}
+
+// maxSeqnoJump returns the largest number of measurements a tag can
+// make in elapsed time.
+func maxSeqnoJump(elapsed time.Duration) int {
+	return maxReorder + int(elapsed/minMeasurementInterval)
+}
+
+// seqnoDiff returns the distance from sequence number prev forward to
+// next and the modulus of the sequence numbers. Sequence numbers are
+// 16-bit in data format 5, where 65535 means not available, and 8-bit
+// in data format 6.
+func seqnoDiff(prev, next, format int) (diff, modulus int) {
+	modulus = ruuvi.SeqnoNA
+	if format == ruuvi.FormatV6 {
+		modulus = 1 << 8
+	}
+	return ((next-prev)%modulus + modulus) % modulus, modulus
+}
+
+// New creates an Exporter. Expired devices are removed in the
+// background until Close is called.
+func New(opts ExporterOpts) *Exporter {
+	if opts.Namespace == "" {
+		opts.Namespace = DefaultNamespace
+	}
+	if opts.TTL == 0 {
+		opts.TTL = DefaultTTL
+	}
+
+	e := &Exporter{
+		ttl:             opts.TTL,
+		keepExpired:     opts.KeepExpired,
+		onExpire:        opts.OnExpire,
+		timestamps:      opts.Timestamps,
+		exportRaw:       opts.ExportRaw,
+		altitude:        opts.Altitude,
+		upName:          prometheus.BuildFQName(opts.Namespace, "", "up"),
+		lastSeenName:    prometheus.BuildFQName(opts.Namespace, "", "last_seen_timestamp_seconds"),
+		quit:            make(chan struct{}),
+		cleanDone:       make(chan struct{}),
+		registry:        prometheus.NewRegistry(),
+		deviceMetrics:   prometheus.NewRegistry(),
+		rawMetrics:      prometheus.NewRegistry(),
+		devices:         make(map[string]*deviceState),
+		decodeErrorSeen: make(map[string]time.Time),
+		subscribers:     make(map[*subscriber]bool),
+		streamsEnd:      make(chan struct{}),
+		cfg:             opts.Config,
+	}
+	e.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		deviceCollector{e},
+	)
+
+	ns := opts.Namespace
+	factory := promauto.With(e.deviceMetrics)
+
+	e.ruuviFrames = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "frames_total",
+		Help:      "Total Ruuvi frames received; frames received by more than one adapter are counted once",
 	}, []string{"device"})
 
-	humidity = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "ruuvi_humidity_ratio",
-		Help: "Ruuvi tag sensor relative humidity",
+	e.adapterFrames = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "adapter_frames_total",
+		Help:      "Total Ruuvi frames received by each Bluetooth adapter",
+	}, []string{"device", "adapter"})
+
+	e.measurements = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "measurements_total",
+		Help:      "Total Ruuvi measurements received; repeated transmissions of a measurement are counted once",
 	}, []string{"device"})
 
-	temperature = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "ruuvi_temperature_celsius",
-		Help: "Ruuvi tag sensor temperature",
+	e.seqnoGaps = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "seqno_gaps_total",
+		Help:      "Total Ruuvi measurements missed, detected from gaps in the sequence number",
 	}, []string{"device"})
 
-	pressure = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "ruuvi_pressure_hpa",
-		Help: "Ruuvi tag sensor air pressure",
+	e.filtered = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "filtered_frames_total",
+		Help:      "Total Ruuvi frames dropped by the device allowlist or denylist",
+	})
+
+	e.decodeErrors = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "decode_errors_total",
+		Help:      "Total Ruuvi frames that failed to decode, by reason: empty, truncated or unknown_format",
+	}, []string{"device", "reason"})
+
+	e.unknownFormat = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "unknown_format_frames_total",
+		Help:      "Total Ruuvi frames of a data format not supported by the decoder",
+	}, []string{"format"})
+
+	e.lastSeen = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "last_seen_timestamp_seconds",
+		Help:      "Time the latest Ruuvi frame was received from the device, in seconds since the Unix epoch",
+	}, []string{"device"})
+
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "devices_active",
+		Help:      "Number of Ruuvi devices seen within the expiry time",
+	}, func() float64 {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		active := 0
+		for _, d := range e.devices {
+			if !d.expired {
+				active++
+			}
+		}
+		return float64(active)
+	})
+
+	e.up = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "up",
+		Help:      "1 if the Ruuvi device has been seen within the expiry time, 0 if expired",
+	}, []string{"device"})
+
+	e.humidity = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "humidity_ratio",
+		Help:      "Ruuvi tag sensor relative humidity",
+	}, []string{"device"})
+
+	e.temperature = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "temperature_celsius",
+		Help:      "Ruuvi tag sensor temperature",
+	}, []string{"device"})
+
+	e.pressure = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "pressure_hpa",
+		Help:      "Ruuvi tag sensor air pressure",
 	}, []string{"device"})
 
-	acceleration = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "ruuvi_acceleration_g",
-		Help: "Ruuvi tag sensor acceleration X/Y/Z",
+	e.seaPressure = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "pressure_sea_level_hpa",
+		Help:      "Ruuvi tag sensor air pressure reduced to sea level by the configured altitude",
+	}, []string{"device"})
+
+	e.dewPoint = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "dew_point_celsius",
+		Help:      "Dew point computed from the Ruuvi tag temperature and relative humidity",
+	}, []string{"device"})
+
+	e.absHumidity = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "absolute_humidity_g_m3",
+		Help:      "Absolute humidity computed from the Ruuvi tag temperature and relative humidity",
+	}, []string{"device"})
+
+	e.vpd = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "vapour_pressure_deficit_kpa",
+		Help:      "Vapour pressure deficit computed from the Ruuvi tag temperature and relative humidity",
+	}, []string{"device"})
+
+	e.acceleration = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "acceleration_g",
+		Help:      "Ruuvi tag sensor acceleration X/Y/Z",
 	}, []string{"device", "axis"})
 
-	voltage = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "ruuvi_battery_volts",
-		Help: "Ruuvi tag battery voltage",
+	e.voltage = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "battery_volts",
+		Help:      "Ruuvi tag battery voltage",
 	}, []string{"device"})
 
-	signalRSSI = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "ruuvi_rssi_dbm",
-		Help: "Ruuvi tag received signal strength RSSI",
+	e.voltageAvg = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "battery_volts_smoothed",
+		Help:      "Ruuvi tag battery voltage averaged over the latest 10 measurements",
 	}, []string{"device"})
 
-	format = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "ruuvi_format",
-		Help: "Ruuvi frame format version (e.g. 3, 5 or 6)",
+	e.batteryLow = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "battery_low",
+		Help:      "1 if the smoothed Ruuvi tag battery voltage is low for the temperature, 0 otherwise",
 	}, []string{"device"})
 
-	txPower = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "ruuvi_txpower_dbm",
-		Help: "Ruuvi transmit power in dBm",
+	e.signalRSSI = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "rssi_dbm",
+		Help:      "Ruuvi tag received signal strength RSSI",
+	}, []string{"device", "adapter"})
+
+	e.format = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "format",
+		Help:      "Ruuvi frame format version (e.g. 3, 5 or 6)",
 	}, []string{"device"})
 
-	moveCount = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "ruuvi_movecount_total",
-		Help: "Ruuvi movement counter",
+	e.txPower = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "txpower_dbm",
+		Help:      "Ruuvi transmit power in dBm",
 	}, []string{"device"})
 
-	seqno = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "ruuvi_seqno_current",
-		Help: "Ruuvi frame sequence number",
+	e.moveCount = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "movecount_total",
+		Help:      "Ruuvi movement counter",
 	}, []string{"device"})
 
-	pm25 = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "ruuvi_pm2_5_ug_m3",
-		Help: "Ruuvi sensor PM2.5 particulate matter concentration",
+	e.movements = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "movements_total",
+		Help:      "Total Ruuvi tag movements detected, from the movement counter",
 	}, []string{"device"})
 
-	co2 = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "ruuvi_co2_ppm",
-		Help: "Ruuvi sensor CO2 concentration",
+	e.accelMag = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "acceleration_magnitude_g",
+		Help:      "Ruuvi tag sensor acceleration magnitude; 1 at rest",
 	}, []string{"device"})
 
-	vocIndex = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "ruuvi_voc_index",
-		Help: "Ruuvi sensor VOC (volatile organic compounds) index",
+	e.tilt = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "tilt_degrees",
+		Help:      "Ruuvi tag tilt from lying flat face up, from the acceleration",
 	}, []string{"device"})
 
-	noxIndex = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "ruuvi_nox_index",
-		Help: "Ruuvi sensor NOx (nitrous oxides) index",
+	e.seqno = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "seqno_current",
+		Help:      "Ruuvi frame sequence number",
 	}, []string{"device"})
 
-	luminosity = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "ruuvi_luminosity_lux",
-		Help: "Ruuvi sensor ambient light level",
+	e.pm25 = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "pm2_5_ug_m3",
+		Help:      "Ruuvi sensor PM2.5 particulate matter concentration",
 	}, []string{"device"})
 
-	soundAvg = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "ruuvi_sound_avg_dba",
-		Help: "Ruuvi sensor A-weighted average sound level",
+	e.co2 = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "co2_ppm",
+		Help:      "Ruuvi sensor CO2 concentration",
 	}, []string{"device"})
 
-	calibrating = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "ruuvi_calibrating",
-		Help: "1 while the Ruuvi sensor calibration is in progress; air quality readings are not exported during calibration",
+	e.vocIndex = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "voc_index",
+		Help:      "Ruuvi sensor VOC (volatile organic compounds) index",
 	}, []string{"device"})
-)
 
-// deviceVecs lists every metric vector with a device label, so that all
-// series of an expired device can be removed without maintaining a
-// per-metric list.
-var deviceVecs = []interface {
-	DeletePartialMatch(prometheus.Labels) int
-}{
-	ruuviFrames, humidity, temperature, pressure, acceleration, voltage,
-	signalRSSI, format, txPower, moveCount, seqno,
-	pm25, co2, vocIndex, noxIndex, luminosity, soundAvg, calibrating,
-}
+	e.noxIndex = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "nox_index",
+		Help:      "Ruuvi sensor NOx (nitrous oxides) index",
+	}, []string{"device"})
 
-// ttl is the duration after which sensors are forgotten if signal is lost.
-const ttl = 1 * time.Minute
+	e.luminosity = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "luminosity_lux",
+		Help:      "Ruuvi sensor ambient light level",
+	}, []string{"device"})
+
+	e.soundAvg = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "sound_avg_dba",
+		Help:      "Ruuvi sensor A-weighted average sound level",
+	}, []string{"device"})
+
+	e.calibrating = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "calibrating",
+		Help:      "1 while the Ruuvi sensor calibration is in progress; air quality readings are not exported during calibration",
+	}, []string{"device"})
+
+	rawFactory := promauto.With(e.rawMetrics)
+	rawGauge := func(name, help string) *prometheus.GaugeVec {
+		return rawFactory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Name:      name,
+			Help:      help,
+		}, []string{"device", "raw"})
+	}
+	e.rawTemperature = rawGauge("temperature_celsius", "Ruuvi tag sensor temperature")
+	e.rawHumidity = rawGauge("humidity_ratio", "Ruuvi tag sensor relative humidity")
+	e.rawPressure = rawGauge("pressure_hpa", "Ruuvi tag sensor air pressure")
+	e.rawCO2 = rawGauge("co2_ppm", "Ruuvi sensor CO2 concentration")
 
-var mu sync.Mutex
-var deviceLastSeen map[string]time.Time
+	e.deviceVecs = []interface {
+		DeletePartialMatch(prometheus.Labels) int
+	}{
+		e.ruuviFrames, e.adapterFrames, e.measurements, e.seqnoGaps, e.decodeErrors, e.lastSeen, e.up,
+		e.humidity, e.temperature, e.pressure, e.seaPressure, e.dewPoint, e.absHumidity, e.vpd, e.acceleration, e.voltage, e.voltageAvg, e.batteryLow,
+		e.signalRSSI, e.format, e.txPower, e.moveCount, e.movements, e.accelMag, e.tilt, e.seqno,
+		e.pm25, e.co2, e.vocIndex, e.noxIndex, e.luminosity, e.soundAvg, e.calibrating,
+		e.rawTemperature, e.rawHumidity, e.rawPressure, e.rawCO2,
+	}
+
+	go e.expireLoop()
+
+	return e
+}
+
+// Close stops removing expired devices in the background and ends the
+// live streams.
+func (e *Exporter) Close() {
+	e.quitOnce.Do(func() {
+		close(e.quit)
+	})
+	e.EndStreams()
+	<-e.cleanDone
+}
 
-func init() {
-	deviceLastSeen = make(map[string]time.Time)
+// Gatherer returns the gatherer of the metrics served by Handler.
+func (e *Exporter) Gatherer() prometheus.Gatherer {
+	return e.registry
+}
 
-	go func() {
-		for range time.Tick(time.Minute) {
-			clearExpired()
+func (e *Exporter) expireLoop() {
+	defer close(e.cleanDone)
+	ticker := time.NewTicker(expireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.clearExpired()
+		case <-e.quit:
+			return
 		}
-	}()
+	}
+}
+
+// SetConfig sets the configuration used to label device metrics.
+// It can be called at any time to reload the configuration.
+func (e *Exporter) SetConfig(c *config.Config) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.cfg = c
 }
 
-func ObserveRuuvi(o RuuviReading) {
+// Observe updates the metrics of the device with the reading o after
+// applying the calibration configured for the device. It returns the
+// calibrated reading and whether it is a new measurement, so that the
+// other outputs receive the same corrected readings once each.
+func (e *Exporter) Observe(o RuuviReading) (RuuviReading, bool) {
+	e.mu.Lock()
+	c := e.cfg.Device(o.Address.String()).Calibration
+	e.mu.Unlock()
+	o = calibrate(o, c)
+	return o, e.observe(o)
+}
+
+// observe updates the metrics of the device with the calibrated
+// reading o. It returns whether o is a new measurement, not a repeated
+// transmission or a frame received by more than one adapter.
+func (e *Exporter) observe(o RuuviReading) bool {
 	addr := o.Address.String()
 
-	mu.Lock()
-	deviceLastSeen[addr] = time.Now()
-	mu.Unlock()
+	now := o.Time
+	if now.IsZero() {
+		now = time.Now()
+	}
 
-	ruuviFrames.WithLabelValues(addr).Inc()
-	signalRSSI.WithLabelValues(addr).Set(float64(o.Rssi))
-	format.WithLabelValues(addr).Set(float64(o.DataFormat))
+	e.mu.Lock()
+	dev := e.cfg.Device(addr)
+	d, ok := e.devices[addr]
+	if !ok {
+		d = &deviceState{adapters: make(map[string]*adapterState)}
+		e.devices[addr] = d
+	}
+	d.lastSeen = now
+	d.observed = time.Now()
+	d.expired = false
+	info := d.update(o, now)
+	a, ok := d.adapters[o.Adapter]
+	if !ok {
+		a = &adapterState{}
+		d.adapters[o.Adapter] = a
+	}
+	a.lastSeen = now
+	a.rssi = int(o.Rssi)
+	a.frames++
+	if !info.duplicate {
+		d.frames++
+	}
+	var voltageAvg float64
+	var moves int
+	if info.measurement {
+		d.measured = now
+		d.reading = o
+		if o.MoveCountValid() {
+			if d.moveValid {
+				moves = movements(d.moveCount, o.MoveCount, info.restarted)
+			}
+			d.moveCount = o.MoveCount
+			d.moveValid = true
+		}
+		if o.VoltageValid() {
+			voltageAvg = d.battery.add(float64(o.Voltage) / 1000)
+		}
+		d.measurements++
+		d.gaps += info.gaps
+	}
+	e.mu.Unlock()
+
+	e.publish(o, dev.Name, now)
+
+	e.lastSeen.WithLabelValues(addr).Set(float64(now.UnixNano()) / 1e9)
+	e.up.WithLabelValues(addr).Set(1)
+	if !info.duplicate {
+		e.ruuviFrames.WithLabelValues(addr).Inc()
+	}
+	e.adapterFrames.WithLabelValues(addr, o.Adapter).Inc()
+	e.signalRSSI.WithLabelValues(addr, o.Adapter).Set(float64(o.Rssi))
+
+	// Repeated transmissions carry the same readings as the measurement
+	// already exported.
+	if !info.measurement {
+		return false
+	}
+	e.measurements.WithLabelValues(addr).Inc()
+	if o.SeqnoValid() {
+		e.seqnoGaps.WithLabelValues(addr).Add(float64(info.gaps))
+	}
+	e.format.WithLabelValues(addr).Set(float64(o.DataFormat))
 
 	if o.VoltageValid() {
-		voltage.WithLabelValues(addr).Set(float64(o.Voltage) / 1000)
+		e.voltage.WithLabelValues(addr).Set(float64(o.Voltage) / 1000)
+		e.voltageAvg.WithLabelValues(addr).Set(voltageAvg)
+		if o.TemperatureValid() {
+			low := 0.0
+			if voltageAvg < batteryLowVolts(float64(o.Temperature)) {
+				low = 1
+			}
+			e.batteryLow.WithLabelValues(addr).Set(low)
+		}
 	}
 	if o.PressureValid() {
-		pressure.WithLabelValues(addr).Set(float64(o.Pressure) / 100)
+		e.pressure.WithLabelValues(addr).Set(float64(o.Pressure) / 100)
 	}
 	if o.TemperatureValid() {
-		temperature.WithLabelValues(addr).Set(float64(o.Temperature))
+		e.temperature.WithLabelValues(addr).Set(float64(o.Temperature))
+	}
+	if altitude := e.deviceAltitude(dev); altitude != nil && o.PressureValid() && o.TemperatureValid() {
+		p := seaLevelPressure(float64(o.Pressure)/100, float64(o.Temperature), *altitude)
+		e.seaPressure.WithLabelValues(addr).Set(p)
 	}
 	if o.HumidityValid() {
-		humidity.WithLabelValues(addr).Set(float64(o.Humidity) / 100)
+		e.humidity.WithLabelValues(addr).Set(float64(o.Humidity) / 100)
+	}
+	// The dew point is undefined for zero humidity.
+	if o.TemperatureValid() && o.HumidityValid() && o.Humidity > 0 {
+		t, rh := float64(o.Temperature), float64(o.Humidity)
+		e.dewPoint.WithLabelValues(addr).Set(dewPoint(t, rh))
+		e.absHumidity.WithLabelValues(addr).Set(absoluteHumidity(t, rh))
+		e.vpd.WithLabelValues(addr).Set(vapourPressureDeficit(t, rh))
 	}
 	if o.AccelerationValid() {
-		acceleration.WithLabelValues(addr, "X").Set(float64(o.AccelerationX))
-		acceleration.WithLabelValues(addr, "Y").Set(float64(o.AccelerationY))
-		acceleration.WithLabelValues(addr, "Z").Set(float64(o.AccelerationZ))
+		e.acceleration.WithLabelValues(addr, "X").Set(float64(o.AccelerationX))
+		e.acceleration.WithLabelValues(addr, "Y").Set(float64(o.AccelerationY))
+		e.acceleration.WithLabelValues(addr, "Z").Set(float64(o.AccelerationZ))
+		x, y, z := float64(o.AccelerationX), float64(o.AccelerationY), float64(o.AccelerationZ)
+		e.accelMag.WithLabelValues(addr).Set(accelerationMagnitude(x, y, z))
+		e.tilt.WithLabelValues(addr).Set(tilt(x, y, z))
+	}
+	if e.exportRaw && o.Raw != nil {
+		e.observeRaw(addr, o.Raw, dev.Calibration)
 	}
 	if o.TxPowerValid() {
-		txPower.WithLabelValues(addr).Set(float64(o.TxPower))
+		e.txPower.WithLabelValues(addr).Set(float64(o.TxPower))
 	}
 	if o.MoveCountValid() {
-		moveCount.WithLabelValues(addr).Set(float64(o.MoveCount))
+		e.moveCount.WithLabelValues(addr).Set(float64(o.MoveCount))
+		e.movements.WithLabelValues(addr).Add(float64(moves))
 	}
 	if o.SeqnoValid() {
-		seqno.WithLabelValues(addr).Set(float64(o.Seqno))
+		e.seqno.WithLabelValues(addr).Set(float64(o.Seqno))
 	}
 	if o.LuminosityValid() {
-		luminosity.WithLabelValues(addr).Set(float64(o.Luminosity))
+		e.luminosity.WithLabelValues(addr).Set(float64(o.Luminosity))
 	}
 	if o.SoundAvgValid() {
-		soundAvg.WithLabelValues(addr).Set(float64(o.SoundAvg))
+		e.soundAvg.WithLabelValues(addr).Set(float64(o.SoundAvg))
 	}
 
 	if o.DataFormat == ruuvi.FormatV6 {
 		if o.Calibrating {
-			calibrating.WithLabelValues(addr).Set(1)
+			e.calibrating.WithLabelValues(addr).Set(1)
 		} else {
-			calibrating.WithLabelValues(addr).Set(0)
+			e.calibrating.WithLabelValues(addr).Set(0)
 		}
 	}
 	// Air quality readings are unreliable while the sensor calibration
 	// is in progress and are not exported until calibration completes.
 	if o.Calibrating {
-		return
+		return true
 	}
 	if o.PM25Valid() {
-		pm25.WithLabelValues(addr).Set(float64(o.PM25))
+		e.pm25.WithLabelValues(addr).Set(float64(o.PM25))
 	}
 	if o.CO2Valid() {
-		co2.WithLabelValues(addr).Set(float64(o.CO2))
+		e.co2.WithLabelValues(addr).Set(float64(o.CO2))
 	}
 	if o.VOCIndexValid() {
-		vocIndex.WithLabelValues(addr).Set(float64(o.VOCIndex))
+		e.vocIndex.WithLabelValues(addr).Set(float64(o.VOCIndex))
 	}
 	if o.NOXIndexValid() {
-		noxIndex.WithLabelValues(addr).Set(float64(o.NOXIndex))
+		e.noxIndex.WithLabelValues(addr).Set(float64(o.NOXIndex))
+	}
+	return true
+}
+
+// observeRaw exports the uncorrected readings raw that calibration c
+// corrects.
+func (e *Exporter) observeRaw(addr string, raw *ruuvi.Data, c config.Calibration) {
+	if c.Temperature != nil && raw.TemperatureValid() {
+		e.rawTemperature.WithLabelValues(addr, "true").Set(float64(raw.Temperature))
+	}
+	if c.Humidity != nil && raw.HumidityValid() {
+		e.rawHumidity.WithLabelValues(addr, "true").Set(float64(raw.Humidity) / 100)
+	}
+	if c.Pressure != nil && raw.PressureValid() {
+		e.rawPressure.WithLabelValues(addr, "true").Set(float64(raw.Pressure) / 100)
+	}
+	if c.CO2 != nil && raw.CO2Valid() && !raw.Calibrating {
+		e.rawCO2.WithLabelValues(addr, "true").Set(float64(raw.CO2))
+	}
+}
+
+// ObserveFiltered counts a frame dropped by the device filter.
+func (e *Exporter) ObserveFiltered() {
+	e.filtered.Inc()
+}
+
+// ObserveDecodeError counts a Ruuvi manufacturer specific data frame
+// data from the device with address addr that failed to decode.
+func (e *Exporter) ObserveDecodeError(addr string, data []byte) {
+	e.mu.Lock()
+	e.decodeErrorSeen[addr] = time.Now()
+	e.mu.Unlock()
+
+	reason, format := decodeErrorReason(data)
+	e.decodeErrors.WithLabelValues(addr, reason).Inc()
+	if reason == "unknown_format" {
+		e.unknownFormat.WithLabelValues(strconv.Itoa(format)).Inc()
 	}
 }
 
-func clearExpired() {
-	mu.Lock()
-	defer mu.Unlock()
+// decodeErrorReason classifies the frame data that failed to decode.
+// The format is the data format of an unknown_format frame.
+func decodeErrorReason(data []byte) (reason string, format int) {
+	// Strip the Ruuvi manufacturer ID as ruuvi.Decode does.
+	if len(data) >= 2 && data[0] == 0x99 && data[1] == 0x04 {
+		data = data[2:]
+	}
+	if len(data) == 0 {
+		return "empty", 0
+	}
+	switch int(data[0]) {
+	case ruuvi.FormatV3, ruuvi.FormatV5, ruuvi.FormatV6:
+		return "truncated", int(data[0])
+	default:
+		return "unknown_format", int(data[0])
+	}
+}
+
+func (e *Exporter) clearExpired() {
+	var expired []string
 
+	e.mu.Lock()
 	now := time.Now()
-	for addr, ls := range deviceLastSeen {
-		if now.Sub(ls) > ttl {
-			for _, vec := range deviceVecs {
-				vec.DeletePartialMatch(prometheus.Labels{"device": addr})
+	for addr, d := range e.devices {
+		if d.expired || now.Sub(d.observed) <= e.deviceTTL(addr) {
+			continue
+		}
+		expired = append(expired, addr)
+		if e.keepExpired {
+			d.expired = true
+			e.up.WithLabelValues(addr).Set(0)
+			continue
+		}
+		e.deleteDevice(addr)
+	}
+	for addr, seen := range e.decodeErrorSeen {
+		if now.Sub(seen) <= e.deviceTTL(addr) {
+			continue
+		}
+		delete(e.decodeErrorSeen, addr)
+		if _, ok := e.devices[addr]; !ok && !e.keepExpired {
+			e.deleteDevice(addr)
+		}
+	}
+	e.mu.Unlock()
+
+	if e.onExpire != nil {
+		for _, addr := range expired {
+			e.onExpire(addr)
+		}
+	}
+}
+
+// deviceTTL returns the expiry duration of the device with address
+// addr. e.mu must be held.
+func (e *Exporter) deviceTTL(addr string) time.Duration {
+	if ttl := e.cfg.Expire(addr); ttl > 0 {
+		return ttl
+	}
+	return e.ttl
+}
+
+// deviceAltitude returns the altitude of the device with settings dev,
+// or nil if not configured.
+func (e *Exporter) deviceAltitude(dev config.Device) *float64 {
+	if dev.Altitude != nil {
+		return dev.Altitude
+	}
+	return e.altitude
+}
+
+// deleteDevice removes all series and state of the device with address
+// addr. e.mu must be held.
+func (e *Exporter) deleteDevice(addr string) {
+	for _, vec := range e.deviceVecs {
+		vec.DeletePartialMatch(prometheus.Labels{"device": addr})
+	}
+	delete(e.devices, addr)
+}
+
+// deviceCollector exports the device metrics of an Exporter with the
+// labels configured for each device added. The labels are added at
+// collection time so that configuration changes apply to existing
+// series.
+type deviceCollector struct{ e *Exporter }
+
+// Describe sends no descriptors, making deviceCollector unchecked, as
+// the label names depend on the configuration.
+func (deviceCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (c deviceCollector) Collect(ch chan<- prometheus.Metric) {
+	families, err := prometheus.Gatherers{c.e.deviceMetrics, c.e.rawMetrics}.Gather()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(prometheus.NewInvalidDesc(err), err)
+		return
+	}
+
+	c.e.mu.Lock()
+	cfg := c.e.cfg
+	var times map[string]deviceTimes
+	if c.e.timestamps {
+		times = make(map[string]deviceTimes, len(c.e.devices))
+		for addr, d := range c.e.devices {
+			adapterSeen := make(map[string]time.Time, len(d.adapters))
+			for adapter, a := range d.adapters {
+				adapterSeen[adapter] = a.lastSeen
 			}
-			delete(deviceLastSeen, addr)
+			times[addr] = deviceTimes{d.lastSeen, d.measured, adapterSeen}
 		}
 	}
+	c.e.mu.Unlock()
+
+	for _, mf := range families {
+		var valueType prometheus.ValueType
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			valueType = prometheus.CounterValue
+		case dto.MetricType_GAUGE:
+			valueType = prometheus.GaugeValue
+		default:
+			valueType = prometheus.UntypedValue
+		}
+		for _, m := range mf.Metric {
+			labels := make(map[string]string)
+			for _, lp := range m.Label {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			for name, value := range cfg.Labels(labels["device"]) {
+				labels[name] = value
+			}
+			names := make([]string, 0, len(labels))
+			for name := range labels {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			values := make([]string, len(names))
+			for i, name := range names {
+				values[i] = labels[name]
+			}
+
+			var value float64
+			switch {
+			case m.Counter != nil:
+				value = m.Counter.GetValue()
+			case m.Gauge != nil:
+				value = m.Gauge.GetValue()
+			case m.Untyped != nil:
+				value = m.Untyped.GetValue()
+			}
+			desc := prometheus.NewDesc(mf.GetName(), mf.GetHelp(), names, nil)
+			metric, err := prometheus.NewConstMetric(desc, valueType, value, values...)
+			if err != nil {
+				metric = prometheus.NewInvalidMetric(desc, err)
+			} else if t := c.timestamp(mf.GetName(), valueType, labels, times); !t.IsZero() {
+				metric = prometheus.NewMetricWithTimestamp(t, metric)
+			}
+			ch <- metric
+		}
+	}
+}
+
+// deviceTimes are the reception times of a device copied for
+// timestamping its samples.
+type deviceTimes struct {
+	lastSeen    time.Time
+	measured    time.Time
+	adapterSeen map[string]time.Time
+}
+
+// timestamp returns the time of the sample of the named metric with
+// labels, or the zero time if the sample is not timestamped. Gauges
+// are timestamped with the time of the measurement they were set
+// from, the per-adapter gauges with the time the adapter last
+// received the device. Counters and ruuvi_up are not timestamped.
+func (c deviceCollector) timestamp(name string, valueType prometheus.ValueType, labels map[string]string, times map[string]deviceTimes) time.Time {
+	if valueType != prometheus.GaugeValue || name == c.e.upName {
+		return time.Time{}
+	}
+	d, ok := times[labels["device"]]
+	switch {
+	case !ok:
+		return time.Time{}
+	case name == c.e.lastSeenName:
+		return d.lastSeen
+	case labels["adapter"] != "":
+		return d.adapterSeen[labels["adapter"]]
+	default:
+		return d.measured
+	}
 }
 
 type RuuviReading struct {
 	*host.ScanReport
 	*ruuvi.Data
+
+	// Adapter is the name of the Bluetooth adapter that received the
+	// advertisement.
+	Adapter string
+
+	// Time is the time the advertisement was received. The time of
+	// Observe is used if zero.
+	Time time.Time
+
+	// Raw is the data before calibration, nil if not calibrated.
+	Raw *ruuvi.Data
 }
@@ -2,8 +2,12 @@ package metrics
 
 import (
 	"encoding/hex"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/joneskoo/ruuvi-prometheus/config"
 	"github.com/prometheus/client_golang/prometheus/testutil"
 	"gitlab.com/jtaimisto/bluewalker/hci"
 	"gitlab.com/jtaimisto/bluewalker/host"
@@ -46,52 +50,457 @@ const v6CalibratingFrame = "990406" + "1297" + "4b7c" + "c625" + "000f" + "03e8"
 // exported while sensor calibration is in progress, and that the
 // calibration status itself is exported.
 func TestCalibrationGatesAirQuality(t *testing.T) {
-	clearDevice(t)
+	e := New(ExporterOpts{})
+	defer e.Close()
 
-	ObserveRuuvi(reading(t, testAddr, v6Frame))
-	if got := testutil.ToFloat64(format.WithLabelValues(testAddr)); got != 6 {
+	e.Observe(reading(t, testAddr, v6Frame))
+	if got := testutil.ToFloat64(e.format.WithLabelValues(testAddr)); got != 6 {
 		t.Fatalf("format = %v, expected 6", got)
 	}
-	if got := testutil.ToFloat64(calibrating.WithLabelValues(testAddr)); got != 0 {
+	if got := testutil.ToFloat64(e.calibrating.WithLabelValues(testAddr)); got != 0 {
 		t.Fatalf("calibrating = %v, expected 0", got)
 	}
-	if got := testutil.ToFloat64(co2.WithLabelValues(testAddr)); got != 777 {
+	if got := testutil.ToFloat64(e.co2.WithLabelValues(testAddr)); got != 777 {
 		t.Fatalf("co2 = %v, expected 777", got)
 	}
-	if got := testutil.ToFloat64(pm25.WithLabelValues(testAddr)); got != float64(float32(9)*0.1) {
+	if got := testutil.ToFloat64(e.pm25.WithLabelValues(testAddr)); got != float64(float32(9)*0.1) {
 		t.Fatalf("pm25 = %v, expected 0.9", got)
 	}
 	// The frame reports sound level as not available, so no series may
 	// be created for it.
-	if got := testutil.CollectAndCount(soundAvg); got != 0 {
+	if got := testutil.CollectAndCount(e.soundAvg); got != 0 {
 		t.Errorf("soundAvg has %d series, expected 0 for unavailable reading", got)
 	}
 
-	ObserveRuuvi(reading(t, testAddr, v6CalibratingFrame))
-	if got := testutil.ToFloat64(calibrating.WithLabelValues(testAddr)); got != 1 {
+	e.Observe(reading(t, testAddr, v6CalibratingFrame))
+	if got := testutil.ToFloat64(e.calibrating.WithLabelValues(testAddr)); got != 1 {
 		t.Errorf("calibrating = %v, expected 1", got)
 	}
 	// Air quality readings from the calibrating frame must not be
 	// exported; the previous values remain.
-	if got := testutil.ToFloat64(co2.WithLabelValues(testAddr)); got != 777 {
+	if got := testutil.ToFloat64(e.co2.WithLabelValues(testAddr)); got != 777 {
 		t.Errorf("co2 = %v after calibrating frame, expected unchanged 777", got)
 	}
-	if got := testutil.ToFloat64(pm25.WithLabelValues(testAddr)); got != float64(float32(9)*0.1) {
+	if got := testutil.ToFloat64(e.pm25.WithLabelValues(testAddr)); got != float64(float32(9)*0.1) {
 		t.Errorf("pm25 = %v after calibrating frame, expected unchanged 0.9", got)
 	}
 	// Environmental readings are exported also during calibration.
-	if got := testutil.ToFloat64(seqno.WithLabelValues(testAddr)); got != 142 {
+	if got := testutil.ToFloat64(e.seqno.WithLabelValues(testAddr)); got != 142 {
 		t.Errorf("seqno = %v after calibrating frame, expected 142", got)
 	}
 }
 
-// clearDevice removes all state for the test device.
-func clearDevice(t *testing.T) {
-	t.Helper()
-	mu.Lock()
-	defer mu.Unlock()
-	for _, vec := range deviceVecs {
-		vec.DeletePartialMatch(map[string]string{"device": testAddr})
+// TestConfigLabels checks that labels configured for a device are added
+// to its series, and that other devices are exported without them.
+func TestConfigLabels(t *testing.T) {
+	cfg, err := config.Parse([]byte(`
+devices:
+  "ee:36:80:be:ec:fd":
+    name: garage
+    labels:
+      id: "2"
+`))
+	if err != nil {
+		t.Fatalf("config.Parse: %v", err)
+	}
+	e := New(ExporterOpts{Config: cfg})
+	defer e.Close()
+
+	e.Observe(reading(t, testAddr, v6Frame))
+	e.Observe(reading(t, "aa:bb:cc:dd:ee:ff", v6Frame))
+
+	expected := `
+# HELP ruuvi_co2_ppm Ruuvi sensor CO2 concentration
+# TYPE ruuvi_co2_ppm gauge
+ruuvi_co2_ppm{device="aa:bb:cc:dd:ee:ff"} 777
+ruuvi_co2_ppm{device="ee:36:80:be:ec:fd",id="2",name="garage"} 777
+`
+	if err := testutil.GatherAndCompare(e.registry, strings.NewReader(expected), "ruuvi_co2_ppm"); err != nil {
+		t.Error(err)
+	}
+
+	// Reloading the configuration changes labels of existing series.
+	e.SetConfig(nil)
+	expected = `
+# HELP ruuvi_co2_ppm Ruuvi sensor CO2 concentration
+# TYPE ruuvi_co2_ppm gauge
+ruuvi_co2_ppm{device="aa:bb:cc:dd:ee:ff"} 777
+ruuvi_co2_ppm{device="ee:36:80:be:ec:fd"} 777
+`
+	if err := testutil.GatherAndCompare(e.registry, strings.NewReader(expected), "ruuvi_co2_ppm"); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestNamespace checks that exporters with different namespaces can
+// coexist.
+func TestNamespace(t *testing.T) {
+	e1 := New(ExporterOpts{})
+	defer e1.Close()
+	e2 := New(ExporterOpts{Namespace: "test"})
+	defer e2.Close()
+	e1.Observe(reading(t, testAddr, v6Frame))
+	e2.Observe(reading(t, testAddr, v6Frame))
+
+	expected := `
+# HELP test_frames_total Total Ruuvi frames received; frames received by more than one adapter are counted once
+# TYPE test_frames_total counter
+test_frames_total{device="ee:36:80:be:ec:fd"} 1
+`
+	if err := testutil.GatherAndCompare(e2.registry, strings.NewReader(expected), "test_frames_total", "ruuvi_frames_total"); err != nil {
+		t.Error(err)
+	}
+	if got := testutil.ToFloat64(e1.ruuviFrames); got != 1 {
+		t.Errorf("ruuvi_frames_total = %v, expected 1", got)
+	}
+}
+
+// TestAdapterDuplicates checks that a frame received by two adapters is
+// counted once in the frames total, and that repeated transmissions
+// heard by the same adapter are counted.
+func TestAdapterDuplicates(t *testing.T) {
+	e := New(ExporterOpts{})
+	defer e.Close()
+	observe := func(adapter, frame string, rssi int8) {
+		o := reading(t, testAddr, frame)
+		o.Adapter = adapter
+		o.Rssi = rssi
+		e.Observe(o)
+	}
+
+	observe("hci0", v6Frame, -60)
+	observe("hci1", v6Frame, -80)
+	observe("hci0", v6Frame, -61) // repeated transmission
+	observe("hci1", v6CalibratingFrame, -79)
+	observe("hci0", v6CalibratingFrame, -62)
+
+	expected := `
+# HELP ruuvi_adapter_frames_total Total Ruuvi frames received by each Bluetooth adapter
+# TYPE ruuvi_adapter_frames_total counter
+ruuvi_adapter_frames_total{adapter="hci0",device="ee:36:80:be:ec:fd"} 3
+ruuvi_adapter_frames_total{adapter="hci1",device="ee:36:80:be:ec:fd"} 2
+# HELP ruuvi_frames_total Total Ruuvi frames received; frames received by more than one adapter are counted once
+# TYPE ruuvi_frames_total counter
+ruuvi_frames_total{device="ee:36:80:be:ec:fd"} 3
+# HELP ruuvi_rssi_dbm Ruuvi tag received signal strength RSSI
+# TYPE ruuvi_rssi_dbm gauge
+ruuvi_rssi_dbm{adapter="hci0",device="ee:36:80:be:ec:fd"} -62
+ruuvi_rssi_dbm{adapter="hci1",device="ee:36:80:be:ec:fd"} -79
+`
+	if err := testutil.GatherAndCompare(e.registry, strings.NewReader(expected),
+		"ruuvi_adapter_frames_total", "ruuvi_frames_total", "ruuvi_rssi_dbm"); err != nil {
+		t.Error(err)
+	}
+}
+
+// v6FrameSeqno returns v6Frame with sequence number seqno.
+func v6FrameSeqno(seqno uint8) string {
+	return v6Frame[:34] + fmt.Sprintf("%02x", seqno) + v6Frame[36:]
+}
+
+// TestMeasurements checks that repeated transmissions of a measurement
+// are counted as frames but not as measurements, and that missed
+// measurements are detected across sequence number wraparound.
+func TestMeasurements(t *testing.T) {
+	e := New(ExporterOpts{})
+	defer e.Close()
+	for _, seqno := range []uint8{250, 250, 250, 251, 254, 254, 1} {
+		e.Observe(reading(t, testAddr, v6FrameSeqno(seqno)))
+	}
+
+	expected := `
+# HELP ruuvi_frames_total Total Ruuvi frames received; frames received by more than one adapter are counted once
+# TYPE ruuvi_frames_total counter
+ruuvi_frames_total{device="ee:36:80:be:ec:fd"} 7
+# HELP ruuvi_measurements_total Total Ruuvi measurements received; repeated transmissions of a measurement are counted once
+# TYPE ruuvi_measurements_total counter
+ruuvi_measurements_total{device="ee:36:80:be:ec:fd"} 4
+# HELP ruuvi_seqno_gaps_total Total Ruuvi measurements missed, detected from gaps in the sequence number
+# TYPE ruuvi_seqno_gaps_total counter
+ruuvi_seqno_gaps_total{device="ee:36:80:be:ec:fd"} 4
+`
+	if err := testutil.GatherAndCompare(e.registry, strings.NewReader(expected),
+		"ruuvi_frames_total", "ruuvi_measurements_total", "ruuvi_seqno_gaps_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSeqnoGaps(t *testing.T) {
+	tests := []struct {
+		prev, next, format int
+		want               int
+	}{
+		{100, 101, ruuvi.FormatV5, 0},
+		{100, 105, ruuvi.FormatV5, 4},
+		{65534, 0, ruuvi.FormatV5, 0},
+		{65533, 1, ruuvi.FormatV5, 2},
+		{100, 50, ruuvi.FormatV5, 0}, // restarted
+		{255, 0, ruuvi.FormatV6, 0},
+		{250, 2, ruuvi.FormatV6, 7},
+		{10, 5, ruuvi.FormatV6, 0},
+	}
+	for _, tt := range tests {
+		if got := seqnoGaps(tt.prev, tt.next, tt.format); got != tt.want {
+			t.Errorf("seqnoGaps(%d, %d, %d) = %d, expected %d", tt.prev, tt.next, tt.format, got, tt.want)
+		}
+	}
+}
+
+func TestLastSeen(t *testing.T) {
+	e := New(ExporterOpts{})
+	defer e.Close()
+	before := time.Now()
+	e.Observe(reading(t, testAddr, v6Frame))
+	e.Observe(reading(t, "aa:bb:cc:dd:ee:ff", v6Frame))
+
+	lastSeen := testutil.ToFloat64(e.lastSeen.WithLabelValues(testAddr))
+	if want := float64(before.Unix()); lastSeen < want || lastSeen > want+60 {
+		t.Errorf("last seen = %v, expected about %v", lastSeen, want)
+	}
+
+	expected := `
+# HELP ruuvi_devices_active Number of Ruuvi devices seen within the expiry time
+# TYPE ruuvi_devices_active gauge
+ruuvi_devices_active 2
+`
+	if err := testutil.GatherAndCompare(e.registry, strings.NewReader(expected), "ruuvi_devices_active"); err != nil {
+		t.Error(err)
+	}
+
+	e.mu.Lock()
+	e.devices[testAddr].observed = before.Add(-2 * DefaultTTL)
+	e.mu.Unlock()
+	e.clearExpired()
+	if got := testutil.CollectAndCount(e.lastSeen); got != 1 {
+		t.Errorf("last seen has %d series after expiry, expected 1", got)
+	}
+	expected = strings.Replace(expected, "ruuvi_devices_active 2", "ruuvi_devices_active 1", 1)
+	if err := testutil.GatherAndCompare(e.registry, strings.NewReader(expected), "ruuvi_devices_active"); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestKeepExpired checks that expired devices are marked down instead
+// of removed in the keep expired mode, and that the expiry duration can
+// be overridden per device.
+func TestKeepExpired(t *testing.T) {
+	cfg, err := config.Parse([]byte(`
+devices:
+  "aa:bb:cc:dd:ee:ff":
+    expire: 1h
+`))
+	if err != nil {
+		t.Fatalf("config.Parse: %v", err)
+	}
+	var expired []string
+	e := New(ExporterOpts{
+		KeepExpired: true,
+		Config:      cfg,
+		OnExpire:    func(device string) { expired = append(expired, device) },
+	})
+	defer e.Close()
+	e.Observe(reading(t, testAddr, v6Frame))
+	e.Observe(reading(t, "aa:bb:cc:dd:ee:ff", v6Frame))
+
+	e.mu.Lock()
+	for _, d := range e.devices {
+		d.observed = d.observed.Add(-2 * DefaultTTL)
+	}
+	e.mu.Unlock()
+	e.clearExpired()
+
+	expected := `
+# HELP ruuvi_devices_active Number of Ruuvi devices seen within the expiry time
+# TYPE ruuvi_devices_active gauge
+ruuvi_devices_active 1
+# HELP ruuvi_up 1 if the Ruuvi device has been seen within the expiry time, 0 if expired
+# TYPE ruuvi_up gauge
+ruuvi_up{device="aa:bb:cc:dd:ee:ff"} 1
+ruuvi_up{device="ee:36:80:be:ec:fd"} 0
+`
+	if err := testutil.GatherAndCompare(e.registry, strings.NewReader(expected), "ruuvi_devices_active", "ruuvi_up"); err != nil {
+		t.Error(err)
+	}
+	if len(expired) != 1 || expired[0] != testAddr {
+		t.Errorf("OnExpire called for %v, expected [%s]", expired, testAddr)
+	}
+	// Devices already expired are not reported again.
+	e.clearExpired()
+	if len(expired) != 1 {
+		t.Errorf("OnExpire called %d times, expected once", len(expired))
+	}
+	if got := testutil.ToFloat64(e.co2.WithLabelValues(testAddr)); got != 777 {
+		t.Errorf("co2 = %v after expiry, expected kept value 777", got)
+	}
+
+	e.Observe(reading(t, testAddr, v6CalibratingFrame))
+	if got := testutil.ToFloat64(e.up.WithLabelValues(testAddr)); got != 1 {
+		t.Errorf("up = %v after new frame, expected 1", got)
+	}
+}
+
+func TestFields(t *testing.T) {
+	names := func(fields []Field) string {
+		var s []string
+		for _, f := range fields {
+			s = append(s, f.Name)
+		}
+		return strings.Join(s, " ")
+	}
+
+	fields := reading(t, testAddr, v6Frame).Fields()
+	if got, want := names(fields), "temperature humidity pressure sequence pm25 co2 voc nox"; got != want {
+		t.Errorf("fields = %s, expected %s", got, want)
+	}
+	for _, f := range fields {
+		if f.Name == "co2" && f.Value != 777 {
+			t.Errorf("co2 = %v, expected 777", f.Value)
+		}
+	}
+
+	// Air quality readings are left out during calibration.
+	fields = reading(t, testAddr, v6CalibratingFrame).Fields()
+	if got, want := names(fields), "temperature humidity pressure sequence"; got != want {
+		t.Errorf("fields while calibrating = %s, expected %s", got, want)
+	}
+}
+
+// TestTimestamps checks that gauges are exported with the reception time
+// of the measurement when enabled.
+func TestTimestamps(t *testing.T) {
+	measured := time.Date(2026, 7, 18, 19, 51, 26, 0, time.UTC)
+	repeated := measured.Add(2 * time.Second)
+
+	for _, enabled := range []bool{false, true} {
+		e := New(ExporterOpts{Timestamps: enabled})
+		defer e.Close()
+
+		o := reading(t, testAddr, v6Frame)
+		o.Adapter, o.Time = "hci0", measured
+		e.Observe(o)
+		o.Adapter, o.Time = "hci1", repeated
+		e.Observe(o)
+
+		families, err := e.registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]int64)
+		for _, mf := range families {
+			for _, m := range mf.GetMetric() {
+				name := mf.GetName()
+				for _, lp := range m.GetLabel() {
+					if lp.GetName() == "adapter" {
+						name += "/" + lp.GetValue()
+					}
+				}
+				got[name] = m.GetTimestampMs()
+			}
+		}
+
+		want := map[string]int64{
+			"ruuvi_temperature_celsius":         measured.UnixMilli(),
+			"ruuvi_rssi_dbm/hci0":               measured.UnixMilli(),
+			"ruuvi_rssi_dbm/hci1":               repeated.UnixMilli(),
+			"ruuvi_last_seen_timestamp_seconds": repeated.UnixMilli(),
+			"ruuvi_up":                          0,
+			"ruuvi_frames_total":                0,
+			"ruuvi_devices_active":              0,
+		}
+		for name, ts := range want {
+			if !enabled {
+				ts = 0
+			}
+			if got[name] != ts {
+				t.Errorf("timestamps %v: %s timestamp %d, expected %d", enabled, name, got[name], ts)
+			}
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	e := New(ExporterOpts{})
+	defer e.Close()
+	e.ObserveDecodeError(testAddr, []byte{0x99, 0x04})
+	e.ObserveDecodeError(testAddr, []byte{0x99, 0x04, 0x06, 0x12})
+	e.ObserveDecodeError(testAddr, []byte{0x99, 0x04, 0xe1, 0x00})
+	e.ObserveDecodeError(testAddr, []byte{0xe1, 0x00})
+
+	for reason, want := range map[string]float64{"empty": 1, "truncated": 1, "unknown_format": 2} {
+		if got := testutil.ToFloat64(e.decodeErrors.WithLabelValues(testAddr, reason)); got != want {
+			t.Errorf("decode errors %s = %v, expected %v", reason, got, want)
+		}
+	}
+	if got := testutil.ToFloat64(e.unknownFormat.WithLabelValues("225")); got != 2 {
+		t.Errorf("unknown format frames = %v, expected 2", got)
+	}
+}
+
+// TestDecodeErrorsExpire checks that the series of a device sending
+// only frames that fail to decode are removed when it expires.
+func TestDecodeErrorsExpire(t *testing.T) {
+	e := New(ExporterOpts{})
+	defer e.Close()
+	e.ObserveDecodeError(testAddr, []byte{0x99, 0x04})
+
+	e.clearExpired()
+	if got := testutil.CollectAndCount(e.decodeErrors); got != 1 {
+		t.Errorf("%d decode error series before expiry, expected 1", got)
+	}
+	e.mu.Lock()
+	e.decodeErrorSeen[testAddr] = e.decodeErrorSeen[testAddr].Add(-2 * DefaultTTL)
+	e.mu.Unlock()
+	e.clearExpired()
+	if got := testutil.CollectAndCount(e.decodeErrors); got != 0 {
+		t.Errorf("%d decode error series after expiry, expected 0", got)
+	}
+}
+
+// TestAdapterDuplicatesLate checks that a copy of a measurement from
+// another adapter is recognised even if it arrives after the next
+// measurement.
+func TestAdapterDuplicatesLate(t *testing.T) {
+	e := New(ExporterOpts{})
+	defer e.Close()
+	for _, f := range []struct {
+		adapter string
+		seqno   uint8
+	}{{"hci0", 100}, {"hci0", 101}, {"hci1", 100}, {"hci1", 101}, {"hci0", 102}} {
+		o := reading(t, testAddr, v6FrameSeqno(f.seqno))
+		o.Adapter = f.adapter
+		e.Observe(o)
+	}
+	d, _ := e.Device(testAddr)
+	if d.Frames != 3 || d.Measurements != 3 {
+		t.Errorf("frames %d, measurements %d; expected 3, 3", d.Frames, d.Measurements)
+	}
+}
+
+// TestSeqnoRestart checks that a frame received late does not replace
+// the latest measurement, and that a tag restarting from a high
+// sequence number is not counted as missing measurements.
+func TestSeqnoRestart(t *testing.T) {
+	e := New(ExporterOpts{})
+	defer e.Close()
+	now := time.Now()
+	for i, f := range []struct {
+		temperature int16
+		seqno       uint16
+	}{{4000, 40000}, {4200, 40002}, {4100, 40001}, {4400, 0}} {
+		o := reading(t, testAddr, v5Frame(f.temperature, 2977, f.seqno))
+		o.Time = now.Add(time.Duration(i) * time.Second)
+		e.Observe(o)
+		if i == 2 {
+			if got := testutil.ToFloat64(e.temperature.WithLabelValues(testAddr)); got != 21 {
+				t.Errorf("temperature after late frame %v, expected 21", got)
+			}
+		}
+	}
+	d, _ := e.Device(testAddr)
+	if d.Frames != 4 || d.Measurements != 3 {
+		t.Errorf("frames %d, measurements %d; expected 4, 3", d.Frames, d.Measurements)
+	}
+	if got := testutil.ToFloat64(e.seqnoGaps.WithLabelValues(testAddr)); got != 1 {
+		t.Errorf("seqno gaps %v, expected 1", got)
 	}
-	delete(deviceLastSeen, testAddr)
 }
@@ -0,0 +1,58 @@
+// Copyright (c) 2018, Joonas Kuorilehto
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package metrics
+
+import "math"
+
+// moveCountModulus is the modulus of the movement counter. It counts
+// from 0 to 254 and wraps around; 255 means not available.
+const moveCountModulus = 255
+
+// movements returns the number of movements between the movement
+// counter values prev and next. If the tag restarted, the counter
+// started again from zero.
+func movements(prev, next int, restarted bool) int {
+	if restarted {
+		return next
+	}
+	return ((next-prev)%moveCountModulus + moveCountModulus) % moveCountModulus
+}
+
+// accelerationMagnitude returns the magnitude of the acceleration
+// vector x, y, z. It is 1 g for a tag at rest.
+func accelerationMagnitude(x, y, z float64) float64 {
+	return math.Sqrt(x*x + y*y + z*z)
+}
+
+// tilt returns the angle in degrees between the acceleration vector
+// x, y, z and the Z axis: 0 for a tag lying flat face up, 90 on its
+// side and 180 upside down. It is zero in free fall.
+func tilt(x, y, z float64) float64 {
+	m := accelerationMagnitude(x, y, z)
+	if m == 0 {
+		return 0
+	}
+	return math.Acos(math.Max(-1, math.Min(1, z/m))) * 180 / math.Pi
+}
@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// v5MoveFrame returns a data format 5 advertisement with movement
+// counter moves and sequence number seqno.
+func v5MoveFrame(moves uint8, seqno uint16) string {
+	f := v5Frame(4860, 2977, seqno)
+	return f[:34] + fmt.Sprintf("%02x", moves) + f[36:]
+}
+
+func TestMovements(t *testing.T) {
+	e := New(ExporterOpts{})
+	defer e.Close()
+	steps := []struct {
+		moves uint8
+		seqno uint16
+		total float64
+	}{
+		{250, 1000, 0}, // first frame
+		{252, 1001, 2}, // two movements
+		{252, 1001, 2}, // repeated transmission
+		{1, 1003, 6},   // wraps around at 255
+		{0, 1002, 6},   // received late
+		{3, 0, 9},      // restarted
+		{3, 1, 9},      // no movement
+	}
+	for i, s := range steps {
+		e.Observe(reading(t, testAddr, v5MoveFrame(s.moves, s.seqno)))
+		if got := testutil.ToFloat64(e.movements.WithLabelValues(testAddr)); got != s.total {
+			t.Errorf("step %d: movements %v, expected %v", i, got, s.total)
+		}
+	}
+}
+
+// TestMovementsRestart checks that a tag restarting from a sequence
+// number in the upper half of the range is not mistaken for a jump
+// forward.
+func TestMovementsRestart(t *testing.T) {
+	e := New(ExporterOpts{})
+	defer e.Close()
+	e.Observe(reading(t, testAddr, v5MoveFrame(100, 40000)))
+	e.Observe(reading(t, testAddr, v5MoveFrame(0, 0)))
+	if got := testutil.ToFloat64(e.movements.WithLabelValues(testAddr)); got != 0 {
+		t.Errorf("movements %v, expected 0", got)
+	}
+	if got := testutil.ToFloat64(e.seqnoGaps.WithLabelValues(testAddr)); got != 0 {
+		t.Errorf("seqno gaps %v, expected 0", got)
+	}
+}
+
+func TestAccelerationMagnitude(t *testing.T) {
+	e := New(ExporterOpts{})
+	defer e.Close()
+	// Acceleration X 0.004, Y -0.004, Z 1.036 g.
+	e.Observe(reading(t, testAddr, v5MoveFrame(0, 0)))
+	if got := testutil.ToFloat64(e.accelMag.WithLabelValues(testAddr)); math.Abs(got-1.036015) > 1e-6 {
+		t.Errorf("acceleration magnitude %v, expected 1.036015", got)
+	}
+	if got := testutil.ToFloat64(e.tilt.WithLabelValues(testAddr)); math.Abs(got-0.3128) > 1e-3 {
+		t.Errorf("tilt %v, expected 0.3128", got)
+	}
+
+	tests := []struct {
+		x, y, z float64
+		want    float64
+	}{
+		{0, 0, 1, 0},
+		{1, 0, 0, 90},
+		{0, -0.5, -0.5, 135},
+		{0, 0, -1, 180},
+		{0, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := tilt(tt.x, tt.y, tt.z); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("tilt(%v, %v, %v) = %v, expected %v", tt.x, tt.y, tt.z, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2018, Joonas Kuorilehto
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package metrics
+
+import "math"
+
+// Magnus formula coefficients over water by Alduchov and Eskridge
+// (1996), accurate to 0.5 % between -40 and 50 °C.
+const (
+	magnusA = 17.625
+	magnusB = 243.04 // °C
+	magnusC = 6.1094 // hPa
+)
+
+// waterVapourGasConstant is the specific gas constant of water vapour
+// in J/(kg·K).
+const waterVapourGasConstant = 461.5
+
+// saturationVapourPressure returns the saturation vapour pressure in
+// hPa at temperature t in °C.
+func saturationVapourPressure(t float64) float64 {
+	return magnusC * math.Exp(magnusA*t/(magnusB+t))
+}
+
+// dewPoint returns the dew point in °C at temperature t in °C and
+// relative humidity rh in percent.
+func dewPoint(t, rh float64) float64 {
+	gamma := math.Log(rh/100) + magnusA*t/(magnusB+t)
+	return magnusB * gamma / (magnusA - gamma)
+}
+
+// absoluteHumidity returns the mass of water vapour in g/m³ at
+// temperature t in °C and relative humidity rh in percent.
+func absoluteHumidity(t, rh float64) float64 {
+	e := saturationVapourPressure(t) * rh / 100 * 100 // Pa
+	return e / (waterVapourGasConstant * (t + 273.15)) * 1000
+}
+
+// vapourPressureDeficit returns the difference between the saturation
+// and actual vapour pressure in kPa at temperature t in °C and relative
+// humidity rh in percent.
+func vapourPressureDeficit(t, rh float64) float64 {
+	return saturationVapourPressure(t) * (1 - rh/100) / 10
+}
+
+// seaLevelPressure returns the pressure reduced to sea level from
+// pressure p measured at altitude h in meters and temperature t in °C,
+// with the barometric formula of the international standard atmosphere
+// lapse rate.
+func seaLevelPressure(p, t, h float64) float64 {
+	const lapseRate = 0.0065 // K/m
+	return p * math.Pow(1-lapseRate*h/(t+lapseRate*h+273.15), -5.257)
+}
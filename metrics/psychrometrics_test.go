@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"math"
+	"testing"
+
+	"github.com/joneskoo/ruuvi-prometheus/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPsychrometrics(t *testing.T) {
+	// Reference values computed from the tabulated saturation vapour
+	// pressure of water (CRC Handbook of Chemistry and Physics). The
+	// Magnus formula is expected to agree within 0.5 % and 0.1 °C.
+	tests := []struct {
+		t, rh       float64
+		dewPoint    float64
+		absHumidity float64
+		vpd         float64
+	}{
+		{20, 50, 9.27, 8.644, 1.1695},
+		{25, 80, 21.30, 18.42, 0.6338},
+		{0, 100, 0, 4.849, 0},
+		{-10, 70, -14.45, 1.651, 0.0860},
+		{35, 30, 14.84, 11.87, 3.940},
+	}
+	for _, tt := range tests {
+		if got := dewPoint(tt.t, tt.rh); math.Abs(got-tt.dewPoint) > 0.1 {
+			t.Errorf("dewPoint(%v, %v) = %.3f, expected %v", tt.t, tt.rh, got, tt.dewPoint)
+		}
+		if got := absoluteHumidity(tt.t, tt.rh); math.Abs(got-tt.absHumidity) > 0.005*tt.absHumidity {
+			t.Errorf("absoluteHumidity(%v, %v) = %.3f, expected %v", tt.t, tt.rh, got, tt.absHumidity)
+		}
+		if got := vapourPressureDeficit(tt.t, tt.rh); math.Abs(got-tt.vpd) > 0.005*tt.vpd+1e-9 {
+			t.Errorf("vapourPressureDeficit(%v, %v) = %.4f, expected %v", tt.t, tt.rh, got, tt.vpd)
+		}
+	}
+}
+
+func TestPsychrometricMetrics(t *testing.T) {
+	e := New(ExporterOpts{})
+	defer e.Close()
+	e.Observe(reading(t, testAddr, v6Frame))
+
+	// v6Frame has temperature 23.795 °C and humidity 48.31 %.
+	if got := testutil.ToFloat64(e.dewPoint.WithLabelValues(testAddr)); math.Abs(got-12.23) > 0.01 {
+		t.Errorf("dew point %v, expected 12.23", got)
+	}
+	if got := testutil.ToFloat64(e.absHumidity.WithLabelValues(testAddr)); math.Abs(got-10.37) > 0.01 {
+		t.Errorf("absolute humidity %v, expected 10.37", got)
+	}
+	if got := testutil.ToFloat64(e.vpd.WithLabelValues(testAddr)); math.Abs(got-1.520) > 0.001 {
+		t.Errorf("vapour pressure deficit %v, expected 1.520", got)
+	}
+}
+
+func TestSeaLevelPressure(t *testing.T) {
+	tests := []struct {
+		p, t, h float64
+		want    float64
+	}{
+		{1013.25, 15, 0, 1013.25},
+		// International standard atmosphere at 100 m and 1000 m.
+		{1001.29, 14.35, 100, 1013.25},
+		{898.75, 8.5, 1000, 1013.25},
+	}
+	for _, tt := range tests {
+		if got := seaLevelPressure(tt.p, tt.t, tt.h); math.Abs(got-tt.want) > 0.1 {
+			t.Errorf("seaLevelPressure(%v, %v, %v) = %.2f, expected %v", tt.p, tt.t, tt.h, got, tt.want)
+		}
+	}
+}
+
+func TestSeaLevelPressureMetric(t *testing.T) {
+	cfg, err := config.Parse([]byte("devices:\n  ee:36:80:be:ec:fd:\n    altitude: 100\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	global := 0.0
+	e := New(ExporterOpts{Config: cfg, Altitude: &global})
+	defer e.Close()
+	e.Observe(reading(t, testAddr, v6Frame))
+	e.Observe(reading(t, "aa:bb:cc:dd:ee:ff", v6Frame))
+
+	// v6Frame has pressure 1007.25 hPa and temperature 23.795 °C.
+	if got := testutil.ToFloat64(e.seaPressure.WithLabelValues(testAddr)); math.Abs(got-1018.89) > 0.01 {
+		t.Errorf("sea level pressure %v, expected 1018.89", got)
+	}
+	if got := testutil.ToFloat64(e.seaPressure.WithLabelValues("aa:bb:cc:dd:ee:ff")); got != 1007.25 {
+		t.Errorf("sea level pressure at global altitude 0 %v, expected 1007.25", got)
+	}
+
+	e2 := New(ExporterOpts{})
+	defer e2.Close()
+	e2.Observe(reading(t, testAddr, v6Frame))
+	if n := testutil.CollectAndCount(e2.seaPressure); n != 0 {
+		t.Errorf("%d sea level pressure series without altitude, expected none", n)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright (c) 2018, Joonas Kuorilehto
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package metrics
+
+import (
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// statusRefresh is the interval at which the status page reloads itself.
+const statusRefresh = 10 * time.Second
+
+// statusColumn is a reading shown on the status page.
+type statusColumn struct {
+	Field    string
+	Title    string
+	Decimals int
+}
+
+// statusColumns are the readings shown on the status page, in order.
+// The RSSI is that of the adapter receiving the device best.
+var statusColumns = []statusColumn{
+	{"temperature", "Temperature °C", 2},
+	{"humidity", "Humidity %", 1},
+	{"pressure", "Pressure hPa", 1},
+	{"co2", "CO2 ppm", 0},
+	{"pm25", "PM2.5 µg/m³", 1},
+	{"voc", "VOC", 0},
+	{"nox", "NOx", 0},
+	{"rssi", "RSSI dBm", 0},
+	{"battery", "Battery V", 3},
+}
+
+// statusDevice is a row of the status page.
+type statusDevice struct {
+	DeviceStatus
+
+	// Values are the readings of statusColumns formatted for display,
+	// empty if not reported.
+	Values []string
+
+	// Age is the number of seconds since the latest frame.
+	Age int
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>ruuvi-prometheus</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { padding: 0.2em 0.6em; border-bottom: 1px solid #ddd; }
+td.num { text-align: right; font-variant-numeric: tabular-nums; }
+tr.down { color: #999; }
+</style>
+</head>
+<body>
+<h1>ruuvi-prometheus exporter</h1>
+<table>
+<tr>
+<th>Device</th><th>Name</th><th>Format</th>
+{{- range .Columns}}<th>{{.Title}}</th>{{end -}}
+<th>Last seen s</th>
+</tr>
+{{- range .Devices}}
+<tr{{if not .Up}} class="down"{{end}}>
+<td><a href="/api/devices/{{.Device}}">{{.Device}}</a></td><td>{{.Name}}</td><td class="num">{{if .Format}}{{.Format}}{{end}}</td>
+{{- range .Values}}<td class="num">{{.}}</td>{{end -}}
+<td class="num">{{.Age}}</td>
+</tr>
+{{- else}}
+<tr><td colspan="{{.Span}}">No devices seen yet.</td></tr>
+{{- end}}
+</table>
+<p>
+<a href="/metrics">/metrics</a> Prometheus metrics endpoint<br>
+<a href="/api/devices">/api/devices</a> Current state of the devices as JSON<br>
+<a href="/api/stream">/api/stream</a> Live stream of the readings as server-sent events
+</p>
+<p><a href="https://github.com/joneskoo/ruuvi-prometheus">https://github.com/joneskoo/ruuvi-prometheus</a></p>
+</body>
+</html>
+`))
+
+// handleRoot serves the status page listing the devices currently
+// known, refreshing itself every statusRefresh.
+func (e *Exporter) handleRoot(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	now := time.Now()
+	var devices []statusDevice
+	for _, d := range e.Devices() {
+		row := statusDevice{
+			DeviceStatus: d,
+			Values:       make([]string, len(statusColumns)),
+			Age:          int(now.Sub(d.LastSeen).Seconds()),
+		}
+		for i, c := range statusColumns {
+			v, ok := d.Readings[c.Field]
+			if c.Field == "rssi" {
+				v, ok = strongestRSSI(d.Adapters)
+			}
+			if ok {
+				row.Values[i] = strconv.FormatFloat(v, 'f', c.Decimals, 64)
+			}
+		}
+		devices = append(devices, row)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	statusTemplate.Execute(w, struct {
+		Refresh int
+		Columns []statusColumn
+		Devices []statusDevice
+		Span    int
+	}{
+		Refresh: int(statusRefresh.Seconds()),
+		Columns: statusColumns,
+		Devices: devices,
+		Span:    len(statusColumns) + 4,
+	})
+}
+
+// strongestRSSI returns the strongest RSSI of the adapters, false if
+// there are none.
+func strongestRSSI(adapters map[string]AdapterStatus) (float64, bool) {
+	var rssi float64
+	var ok bool
+	for _, a := range adapters {
+		if !ok || float64(a.RSSI) > rssi {
+			rssi, ok = float64(a.RSSI), true
+		}
+	}
+	return rssi, ok
+}
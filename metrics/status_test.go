@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/joneskoo/ruuvi-prometheus/config"
+)
+
+func TestStatusPage(t *testing.T) {
+	cfg, err := config.Parse([]byte(`
+devices:
+  ee:36:80:be:ec:fd:
+    name: <office>
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := New(ExporterOpts{Config: cfg})
+	defer e.Close()
+	e.Observe(reading(t, testAddr, v6Frame))
+	o := reading(t, testAddr, v6Frame)
+	o.Adapter, o.Rssi = "hci1", -55
+	e.Observe(o)
+
+	srv := httptest.NewServer(e.Handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("Content-Type %q", ct)
+	}
+	for _, want := range []string{testAddr, "&lt;office&gt;", "<td class=\"num\">777</td>", "<td class=\"num\">-55</td>", "http-equiv=\"refresh\""} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("status page does not contain %q:\n%s", want, body)
+		}
+	}
+
+	get(t, srv.URL+"/missing", http.StatusNotFound, nil)
+}
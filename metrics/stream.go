@@ -0,0 +1,182 @@
+// Copyright (c) 2018, Joonas Kuorilehto
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// streamBuffer is the number of events buffered for each live
+	// stream client. Events are dropped for clients that fall behind.
+	streamBuffer = 64
+
+	// streamKeepalive is the interval of keepalive comments sent to
+	// idle live stream clients.
+	streamKeepalive = 30 * time.Second
+)
+
+// StreamEvent is a reading sent to the live stream clients.
+type StreamEvent struct {
+	// ID increases with every reading published, including readings
+	// of devices filtered out from the client.
+	ID uint64 `json:"id"`
+
+	Device   string             `json:"device"`
+	Name     string             `json:"name,omitempty"`
+	Adapter  string             `json:"adapter"`
+	Time     time.Time          `json:"time"`
+	Format   int                `json:"format"`
+	RSSI     int                `json:"rssi"`
+	Readings map[string]float64 `json:"readings"`
+}
+
+// subscriber is a live stream client.
+type subscriber struct {
+	// devices are the device addresses and names to send, or nil for
+	// all devices.
+	devices map[string]bool
+	events  chan StreamEvent
+}
+
+// subscribe adds a live stream client for devices, or all devices if
+// empty.
+func (e *Exporter) subscribe(devices []string) *subscriber {
+	s := &subscriber{events: make(chan StreamEvent, streamBuffer)}
+	if len(devices) > 0 {
+		s.devices = make(map[string]bool)
+		for _, d := range devices {
+			s.devices[strings.ToLower(d)] = true
+		}
+	}
+	e.streamMu.Lock()
+	defer e.streamMu.Unlock()
+	e.subscribers[s] = true
+	return s
+}
+
+func (e *Exporter) unsubscribe(s *subscriber) {
+	e.streamMu.Lock()
+	defer e.streamMu.Unlock()
+	delete(e.subscribers, s)
+}
+
+// publish sends the reading o of the device with the configured name to
+// the live stream clients. It never blocks; events are dropped for
+// clients whose buffer is full.
+func (e *Exporter) publish(o RuuviReading, name string, received time.Time) {
+	e.streamMu.Lock()
+	defer e.streamMu.Unlock()
+	if len(e.subscribers) == 0 {
+		return
+	}
+	e.streamID++
+	addr := o.Address.String()
+	ev := StreamEvent{
+		ID:       e.streamID,
+		Device:   addr,
+		Name:     name,
+		Adapter:  o.Adapter,
+		Time:     received,
+		Format:   o.DataFormat,
+		RSSI:     int(o.Rssi),
+		Readings: make(map[string]float64),
+	}
+	for _, f := range o.Fields() {
+		ev.Readings[f.Name] = f.Value
+	}
+	for s := range e.subscribers {
+		if s.devices != nil && !s.devices[addr] && !s.devices[strings.ToLower(name)] {
+			continue
+		}
+		select {
+		case s.events <- ev:
+		default:
+		}
+	}
+}
+
+// EndStreams ends the live streams, e.g. for a graceful shutdown of the
+// HTTP server, which waits for the streaming requests to complete.
+func (e *Exporter) EndStreams() {
+	e.streamsEndOnce.Do(func() {
+		close(e.streamsEnd)
+	})
+}
+
+// handleStream streams the readings as server-sent events. The devices
+// can be limited with the device query parameter, a device address or
+// configured name, repeated or separated with commas.
+func (e *Exporter) handleStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	var devices []string
+	for _, v := range r.URL.Query()["device"] {
+		for _, d := range strings.Split(v, ",") {
+			if d = strings.TrimSpace(d); d != "" {
+				devices = append(devices, d)
+			}
+		}
+	}
+
+	s := e.subscribe(devices)
+	defer e.unsubscribe(s)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case ev := <-s.events:
+			data, err := json.Marshal(ev)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: reading\ndata: %s\n\n", ev.ID, data); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-e.streamsEnd:
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStream(t *testing.T) {
+	e := New(ExporterOpts{})
+	defer e.Close()
+	srv := httptest.NewServer(e.Handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/api/stream?device=" + strings.ToUpper(testAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type %q", ct)
+	}
+
+	// The response headers are flushed after subscribing.
+	e.Observe(reading(t, "00:11:22:33:44:55", v6Frame))
+	e.Observe(reading(t, testAddr, v6Frame))
+
+	events := make(chan StreamEvent)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				var ev StreamEvent
+				if err := json.Unmarshal([]byte(data), &ev); err != nil {
+					t.Errorf("invalid event %q: %v", data, err)
+				}
+				events <- ev
+			}
+		}
+	}()
+
+	select {
+	case ev := <-events:
+		if ev.Device != testAddr || ev.ID != 2 || ev.Readings["co2"] != 777 {
+			t.Errorf("unexpected event %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+}
+
+// TestStreamSlowClient checks that readings are dropped rather than
+// blocking Observe when a client does not keep up.
+func TestStreamSlowClient(t *testing.T) {
+	e := New(ExporterOpts{})
+	defer e.Close()
+	s := e.subscribe(nil)
+
+	o := reading(t, testAddr, v6Frame)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 2*streamBuffer; i++ {
+			e.Observe(o)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Observe blocked by slow client")
+	}
+	if len(s.events) != streamBuffer {
+		t.Errorf("%d events buffered, expected %d", len(s.events), streamBuffer)
+	}
+}
+
+// TestStreamShutdown checks that a graceful HTTP server shutdown is not
+// blocked by a connected live stream client.
+func TestStreamShutdown(t *testing.T) {
+	e := New(ExporterOpts{})
+	defer e.Close()
+	srv := httptest.NewUnstartedServer(e.Handler())
+	srv.Config.RegisterOnShutdown(e.EndStreams)
+	srv.Start()
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/api/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Config.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+}
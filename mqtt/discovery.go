@@ -0,0 +1,225 @@
+// Copyright (c) 2018, Joonas Kuorilehto
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/joneskoo/ruuvi-prometheus/metrics"
+)
+
+// DefaultDiscoveryPrefix is the default Home Assistant MQTT discovery
+// topic prefix.
+const DefaultDiscoveryPrefix = "homeassistant"
+
+// removeTimeout limits the wait for the broker to acknowledge the
+// removal of a discovery configuration.
+const removeTimeout = 10 * time.Second
+
+// haSensor describes a reading field as a Home Assistant sensor.
+type haSensor struct {
+	name        string
+	deviceClass string
+}
+
+// haSensors lists the reading fields announced to Home Assistant.
+var haSensors = map[string]haSensor{
+	"temperature": {"Temperature", "temperature"},
+	"humidity":    {"Humidity", "humidity"},
+	"pressure":    {"Pressure", "atmospheric_pressure"},
+	"battery":     {"Battery voltage", "voltage"},
+	"co2":         {"CO2", "carbon_dioxide"},
+	"pm25":        {"PM2.5", "pm25"},
+	"voc":         {"VOC index", ""},
+	"nox":         {"NOx index", ""},
+	"luminosity":  {"Illuminance", "illuminance"},
+	"sound_avg":   {"Sound level", "sound_pressure"},
+}
+
+// haConfig is a Home Assistant MQTT discovery sensor configuration.
+type haConfig struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	StateTopic        string   `json:"state_topic"`
+	ValueTemplate     string   `json:"value_template"`
+	UnitOfMeasurement string   `json:"unit_of_measurement,omitempty"`
+	DeviceClass       string   `json:"device_class,omitempty"`
+	StateClass        string   `json:"state_class"`
+	Device            haDevice `json:"device"`
+}
+
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+}
+
+// discoveryID returns the Home Assistant identifier of the device with
+// address addr.
+func discoveryID(addr string) string {
+	return "ruuvi_" + strings.ReplaceAll(addr, ":", "")
+}
+
+// configTopic returns the discovery topic of the reading field of the
+// device with address addr.
+func (p *Publisher) configTopic(addr, field string) string {
+	return fmt.Sprintf("%s/sensor/%s/%s/config", p.discoveryPrefix, discoveryID(addr), field)
+}
+
+// announce publishes the discovery configuration of the fields of o not
+// yet announced, and then the device state.
+func (p *Publisher) announce(o metrics.RuuviReading, fields []metrics.Field) {
+	addr := o.Address.String()
+	stateTopic := p.topicFor(addr, "state")
+
+	p.mu.Lock()
+	dev := p.cfg.Device(addr)
+	delete(p.expired, addr)
+	announced := p.announced[addr]
+	if announced == nil {
+		announced = make(map[string]bool)
+		p.announced[addr] = announced
+	}
+	published := p.published[addr]
+	if published == nil {
+		published = make(map[string]bool)
+		p.published[addr] = published
+	}
+	var pending []metrics.Field
+	for _, f := range fields {
+		if _, ok := haSensors[f.Name]; ok && !announced[f.Name] {
+			announced[f.Name] = true
+			published[f.Name] = true
+			pending = append(pending, f)
+		}
+	}
+	p.mu.Unlock()
+
+	name := dev.Name
+	if name == "" {
+		name = "Ruuvi " + strings.ToUpper(strings.ReplaceAll(addr[len(addr)-5:], ":", ""))
+	}
+	device := haDevice{
+		Identifiers:  []string{discoveryID(addr)},
+		Name:         name,
+		Manufacturer: "Ruuvi Innovations",
+		Model:        fmt.Sprintf("Data format %d", o.DataFormat),
+	}
+	for _, f := range pending {
+		sensor := haSensors[f.Name]
+		payload, err := json.Marshal(haConfig{
+			Name:              sensor.name,
+			UniqueID:          discoveryID(addr) + "_" + f.Name,
+			StateTopic:        stateTopic,
+			ValueTemplate:     fmt.Sprintf("{{ value_json.%s }}", f.Name),
+			UnitOfMeasurement: f.Unit,
+			DeviceClass:       sensor.deviceClass,
+			StateClass:        "measurement",
+			Device:            device,
+		})
+		if err != nil {
+			p.log.Printf("Home Assistant discovery: %v", err)
+			continue
+		}
+		p.client.Publish(p.configTopic(addr, f.Name), 1, true, payload)
+	}
+
+	state := make(map[string]json.Number, len(fields))
+	for _, f := range fields {
+		state[f.Name] = json.Number(f.FormatValue())
+	}
+	payload, err := json.Marshal(state)
+	if err != nil {
+		p.log.Printf("Home Assistant state: %v", err)
+		return
+	}
+	p.client.Publish(stateTopic, p.qos, p.retain, payload)
+}
+
+// Expire removes the Home Assistant discovery configuration of the
+// device with address addr, or once connected again if the broker can
+// not be reached. It is a no-op if discovery is not enabled.
+func (p *Publisher) Expire(addr string) {
+	if !p.discovery {
+		return
+	}
+	p.mu.Lock()
+	if len(p.published[addr]) > 0 {
+		p.expired[addr] = true
+	}
+	p.mu.Unlock()
+	p.removeExpired()
+}
+
+// removeExpired removes the discovery configuration of the expired
+// devices. A device is forgotten only after the broker has acknowledged
+// the removal of all its configuration.
+func (p *Publisher) removeExpired() {
+	if !p.client.IsConnectionOpen() {
+		return
+	}
+	p.mu.Lock()
+	pending := make(map[string][]string, len(p.expired))
+	for addr := range p.expired {
+		for field := range p.published[addr] {
+			pending[addr] = append(pending[addr], field)
+		}
+	}
+	p.mu.Unlock()
+
+	for addr, fields := range pending {
+		var tokens []paho.Token
+		for _, field := range fields {
+			tokens = append(tokens, p.client.Publish(p.configTopic(addr, field), 1, true, []byte{}))
+		}
+		removed := true
+		for _, t := range tokens {
+			if !t.WaitTimeout(removeTimeout) || t.Error() != nil {
+				removed = false
+			}
+		}
+		if !removed {
+			p.log.Printf("Home Assistant discovery: removing %s not acknowledged; retrying on reconnect", addr)
+			continue
+		}
+
+		p.mu.Lock()
+		// A device seen again meanwhile is announced again.
+		for _, field := range fields {
+			delete(p.published[addr], field)
+			delete(p.announced[addr], field)
+		}
+		if len(p.published[addr]) == 0 {
+			delete(p.published, addr)
+			delete(p.expired, addr)
+		}
+		p.mu.Unlock()
+	}
+}
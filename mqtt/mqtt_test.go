@@ -0,0 +1,312 @@
+package mqtt
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/joneskoo/ruuvi-prometheus/config"
+	"github.com/joneskoo/ruuvi-prometheus/metrics"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"gitlab.com/jtaimisto/bluewalker/hci"
+	"gitlab.com/jtaimisto/bluewalker/host"
+	"gitlab.com/jtaimisto/bluewalker/ruuvi"
+)
+
+const testAddr = "ee:36:80:be:ec:fd"
+
+// v6Frame is a Ruuvi Air data format 6 advertisement with temperature
+// 23.795 °C and CO2 777 ppm.
+const v6Frame = "99040612974b7cc625000903090700ffff8d94beecfd"
+
+func reading(t *testing.T) metrics.RuuviReading {
+	t.Helper()
+	data, err := hex.DecodeString(v6Frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := ruuvi.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := hci.BtAddressFromString(testAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return metrics.RuuviReading{
+		ScanReport: &host.ScanReport{Address: addr, Rssi: -60},
+		Data:       decoded,
+	}
+}
+
+// broker is an in-process MQTT broker recording published messages.
+type broker struct {
+	server *mochi.Server
+
+	mu       sync.Mutex
+	messages map[string]string
+	retained map[string]bool
+}
+
+// startBroker starts a broker listening on addr.
+func startBroker(t *testing.T, addr string) *broker {
+	t.Helper()
+	b := &broker{
+		messages: make(map[string]string),
+		retained: make(map[string]bool),
+	}
+	b.server = mochi.New(&mochi.Options{
+		InlineClient: true,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err := b.server.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.server.AddListener(listeners.NewTCP(listeners.Config{ID: "tcp", Address: addr})); err != nil {
+		t.Fatal(err)
+	}
+	err := b.server.Subscribe("#", 1, func(_ *mochi.Client, _ packets.Subscription, pk packets.Packet) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.messages[pk.TopicName] = string(pk.Payload)
+		b.retained[pk.TopicName] = pk.FixedHeader.Retain
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.server.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func (b *broker) message(topic string) (payload string, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	payload, ok = b.messages[topic]
+	return payload, ok
+}
+
+// freeAddr returns a free local TCP address.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// waitFor calls f until it returns true or the test times out.
+func waitFor(t *testing.T, what string, f func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !f() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newTestPublisher(t *testing.T, opts PublisherOpts) *Publisher {
+	t.Helper()
+	opts.Logger = log.New(io.Discard, "", 0)
+	p, err := NewPublisher(opts)
+	if err != nil {
+		t.Fatalf("NewPublisher: %v", err)
+	}
+	t.Cleanup(p.Close)
+	return p
+}
+
+func TestPublish(t *testing.T) {
+	addr := freeAddr(t)
+	b := startBroker(t, addr)
+	defer b.server.Close()
+
+	cfg, err := config.Parse([]byte("devices:\n  \"" + testAddr + "\":\n    name: kitchen\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestPublisher(t, PublisherOpts{
+		Broker: "tcp://" + addr,
+		Topic:  "home/{name}/{field}",
+		QoS:    1,
+		Retain: true,
+		Config: cfg,
+	})
+
+	waitFor(t, "published message", func() bool {
+		p.Observe(reading(t))
+		_, ok := b.message("home/kitchen/co2")
+		return ok
+	})
+	if got, _ := b.message("home/kitchen/temperature"); got != "23.795" {
+		t.Errorf("temperature = %q, expected 23.795", got)
+	}
+	if got, _ := b.message("home/kitchen/co2"); got != "777" {
+		t.Errorf("co2 = %q, expected 777", got)
+	}
+	if _, ok := b.message("home/kitchen/battery"); ok {
+		t.Error("battery published, but data format 6 does not report it")
+	}
+	b.mu.Lock()
+	retained := b.retained["home/kitchen/co2"]
+	b.mu.Unlock()
+	if !retained {
+		t.Error("message not retained")
+	}
+
+	// Without a configured name the device address is used.
+	p.SetConfig(nil)
+	waitFor(t, "message for unnamed device", func() bool {
+		p.Observe(reading(t))
+		_, ok := b.message("home/" + testAddr + "/co2")
+		return ok
+	})
+}
+
+// TestReconnect checks that the publisher reconnects when the broker
+// is restarted.
+func TestReconnect(t *testing.T) {
+	addr := freeAddr(t)
+	b := startBroker(t, addr)
+	p := newTestPublisher(t, PublisherOpts{Broker: "tcp://" + addr})
+	waitFor(t, "connection", p.client.IsConnectionOpen)
+
+	b.server.Close()
+	waitFor(t, "connection lost", func() bool { return !p.client.IsConnectionOpen() })
+
+	b = startBroker(t, addr)
+	defer b.server.Close()
+	waitFor(t, "message after reconnect", func() bool {
+		p.Observe(reading(t))
+		_, ok := b.message("ruuvi/" + testAddr + "/co2")
+		return ok
+	})
+}
+
+func TestNewPublisherErrors(t *testing.T) {
+	if _, err := NewPublisher(PublisherOpts{Broker: "tcp://localhost:1883", Topic: "ruuvi/{name}"}); err == nil {
+		t.Error("expected error for topic without {field}")
+	}
+	if _, err := NewPublisher(PublisherOpts{Broker: "tcp://localhost:1883", QoS: 3}); err == nil {
+		t.Error("expected error for invalid QoS")
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	addr := freeAddr(t)
+	b := startBroker(t, addr)
+	defer b.server.Close()
+
+	p := newTestPublisher(t, PublisherOpts{
+		Broker:    "tcp://" + addr,
+		Discovery: true,
+	})
+	const configTopic = "homeassistant/sensor/ruuvi_ee3680beecfd/co2/config"
+	waitFor(t, "discovery configuration", func() bool {
+		p.Observe(reading(t))
+		_, ok := b.message(configTopic)
+		return ok
+	})
+
+	payload, _ := b.message(configTopic)
+	var got haConfig
+	if err := json.Unmarshal([]byte(payload), &got); err != nil {
+		t.Fatalf("invalid configuration %q: %v", payload, err)
+	}
+	want := haConfig{
+		Name:              "CO2",
+		UniqueID:          "ruuvi_ee3680beecfd_co2",
+		StateTopic:        "ruuvi/" + testAddr + "/state",
+		ValueTemplate:     "{{ value_json.co2 }}",
+		UnitOfMeasurement: "ppm",
+		DeviceClass:       "carbon_dioxide",
+		StateClass:        "measurement",
+		Device: haDevice{
+			Identifiers:  []string{"ruuvi_ee3680beecfd"},
+			Name:         "Ruuvi ECFD",
+			Manufacturer: "Ruuvi Innovations",
+			Model:        "Data format 6",
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("configuration = %+v, expected %+v", got, want)
+	}
+
+	// Data format 6 does not report battery voltage, and sequence
+	// numbers are not announced.
+	for _, field := range []string{"battery", "sequence"} {
+		if _, ok := b.message("homeassistant/sensor/ruuvi_ee3680beecfd/" + field + "/config"); ok {
+			t.Errorf("%s announced", field)
+		}
+	}
+
+	waitFor(t, "state", func() bool {
+		_, ok := b.message("ruuvi/" + testAddr + "/state")
+		return ok
+	})
+	state, _ := b.message("ruuvi/" + testAddr + "/state")
+	var values map[string]float64
+	if err := json.Unmarshal([]byte(state), &values); err != nil {
+		t.Fatalf("invalid state %q: %v", state, err)
+	}
+	if values["co2"] != 777 {
+		t.Errorf("state co2 = %v, expected 777", values["co2"])
+	}
+
+	// Configuration published before a reload is also removed.
+	p.SetConfig(nil)
+	p.Expire(testAddr)
+	waitFor(t, "configuration removal", func() bool {
+		payload, _ := b.message(configTopic)
+		return payload == ""
+	})
+}
+
+// TestDiscoveryExpireDisconnected checks that the discovery
+// configuration of a device expiring while disconnected is removed
+// after reconnecting.
+func TestDiscoveryExpireDisconnected(t *testing.T) {
+	addr := freeAddr(t)
+	b := startBroker(t, addr)
+	p := newTestPublisher(t, PublisherOpts{
+		Broker:    "tcp://" + addr,
+		Discovery: true,
+	})
+	const configTopic = "homeassistant/sensor/ruuvi_ee3680beecfd/co2/config"
+	waitFor(t, "discovery configuration", func() bool {
+		p.Observe(reading(t))
+		_, ok := b.message(configTopic)
+		return ok
+	})
+
+	b.server.Close()
+	waitFor(t, "connection lost", func() bool { return !p.client.IsConnectionOpen() })
+	p.Expire(testAddr)
+
+	b = startBroker(t, addr)
+	defer b.server.Close()
+	waitFor(t, "configuration removal", func() bool {
+		payload, ok := b.message(configTopic)
+		return ok && payload == ""
+	})
+	waitFor(t, "device forgotten", func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return len(p.published) == 0 && len(p.expired) == 0
+	})
+}
@@ -0,0 +1,224 @@
+package remotewrite
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// unmarshalWriteRequest decodes a WriteRequest to one string per series,
+// e.g. `name{a="b"} 1 @1000`.
+func unmarshalWriteRequest(t *testing.T, b []byte) []string {
+	t.Helper()
+	var out []string
+	for len(b) > 0 {
+		_, _, n := protowire.ConsumeTag(b)
+		b = b[n:]
+		ts, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			t.Fatalf("invalid WriteRequest")
+		}
+		b = b[n:]
+
+		var name string
+		var labels []string
+		var sample string
+		for len(ts) > 0 {
+			num, _, n := protowire.ConsumeTag(ts)
+			ts = ts[n:]
+			msg, n := protowire.ConsumeBytes(ts)
+			ts = ts[n:]
+			fields := map[protowire.Number][]byte{}
+			var value float64
+			var timestamp uint64
+			for len(msg) > 0 {
+				fnum, typ, n := protowire.ConsumeTag(msg)
+				msg = msg[n:]
+				switch typ {
+				case protowire.BytesType:
+					v, n := protowire.ConsumeBytes(msg)
+					fields[fnum] = v
+					msg = msg[n:]
+				case protowire.Fixed64Type:
+					v, n := protowire.ConsumeFixed64(msg)
+					value = math.Float64frombits(v)
+					msg = msg[n:]
+				case protowire.VarintType:
+					v, n := protowire.ConsumeVarint(msg)
+					timestamp = v
+					msg = msg[n:]
+				}
+			}
+			if num == fieldLabels {
+				if string(fields[fieldLabelName]) == "__name__" {
+					name = string(fields[fieldLabelValue])
+				} else {
+					labels = append(labels, string(fields[fieldLabelName])+"="+`"`+string(fields[fieldLabelValue])+`"`)
+				}
+			} else {
+				sample = formatFloat(value) + " @" + formatFloat(float64(timestamp))
+			}
+		}
+		out = append(out, name+"{"+strings.Join(labels, ",")+"} "+sample)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func testRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	g := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "ruuvi_temperature_celsius"}, []string{"device"})
+	g.WithLabelValues("ee:36:80:be:ec:fd").Set(21.5)
+	h := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "latency_seconds", Buckets: []float64{1}})
+	h.Observe(0.5)
+	reg.MustRegister(g, h)
+	return reg
+}
+
+func TestWriteRequest(t *testing.T) {
+	families, err := testRegistry().Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := toSeries(families, map[string]string{"job": "ruuvi"}, 1000)
+	got := unmarshalWriteRequest(t, marshalWriteRequest(ss))
+	want := []string{
+		`latency_seconds_bucket{job="ruuvi",le="+Inf"} 1 @1000`,
+		`latency_seconds_bucket{job="ruuvi",le="1"} 1 @1000`,
+		`latency_seconds_count{job="ruuvi"} 1 @1000`,
+		`latency_seconds_sum{job="ruuvi"} 0.5 @1000`,
+		`ruuvi_temperature_celsius{device="ee:36:80:be:ec:fd",job="ruuvi"} 21.5 @1000`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("series:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// TestWAL checks that pushes are kept on disk while the remote storage
+// fails and sent in order by a later Pusher.
+func TestWAL(t *testing.T) {
+	dir := t.TempDir()
+
+	var mu sync.Mutex
+	up := false
+	var received [][]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !up {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Content-Encoding") != "snappy" {
+			t.Errorf("Content-Encoding = %q", r.Header.Get("Content-Encoding"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		data, err := s2.Decode(nil, body)
+		if err != nil {
+			t.Errorf("snappy decode: %v", err)
+		}
+		received = append(received, unmarshalWriteRequest(t, data))
+	}))
+	defer srv.Close()
+
+	opts := PusherOpts{
+		URL:      srv.URL,
+		Gatherer: testRegistry(),
+		Interval: time.Hour,
+		Dir:      dir,
+	}
+	p, err := NewPusher(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+	if p.queue.Len() != 2 {
+		t.Fatalf("%d pushes pending, want 2", p.queue.Len())
+	}
+
+	mu.Lock()
+	up = true
+	mu.Unlock()
+	p, err = NewPusher(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 4 {
+		t.Fatalf("received %d pushes, want 4", len(received))
+	}
+	if p.queue.Len() != 0 {
+		t.Errorf("%d pushes pending after send", p.queue.Len())
+	}
+	var last float64
+	for _, series := range received {
+		ts, err := strconv.ParseFloat(series[0][strings.LastIndex(series[0], "@")+1:], 64)
+		if err != nil {
+			t.Fatalf("invalid timestamp in %q: %v", series[0], err)
+		}
+		if ts < last {
+			t.Errorf("pushes out of order: %v after %v", ts, last)
+		}
+		last = ts
+	}
+}
+
+// TestTimeout checks that a push to remote storage that does not
+// respond is abandoned and kept for retry.
+func TestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	p, err := NewPusher(PusherOpts{
+		URL:      srv.URL,
+		Gatherer: testRegistry(),
+		Interval: 100 * time.Millisecond,
+		Dir:      t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+	if p.queue.Len() == 0 {
+		t.Error("no pushes pending after timeout")
+	}
+}
+
+func TestQueueLimit(t *testing.T) {
+	q, err := openQueue(t.TempDir(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dropped int
+	for _, s := range []string{"a", "b", "c"} {
+		n, err := q.Push([]byte(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dropped += n
+	}
+	if dropped != 1 || q.Len() != 2 {
+		t.Errorf("dropped %d, len %d; want 1 and 2", dropped, q.Len())
+	}
+	if b, _ := q.Peek(); string(b) != "b" {
+		t.Errorf("oldest %q, want b", b)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2018, Joonas Kuorilehto
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package remotewrite
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// walSuffix is the file name suffix of the write-ahead log segments.
+const walSuffix = ".wal"
+
+// queue is a FIFO of encoded write requests waiting to be sent. The
+// requests are stored as files in dir, one request per file named by
+// its sequence number, so that they survive restarts.
+type queue struct {
+	dir string
+	max int
+
+	seqs []uint64 // sequence numbers of the files in dir, oldest first
+	next uint64
+}
+
+// openQueue opens the queue in dir, creating dir if necessary, and
+// loads the sequence numbers of requests left from earlier runs.
+func openQueue(dir string, max int) (*queue, error) {
+	q := &queue{dir: dir, max: max}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, walSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, walSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		q.seqs = append(q.seqs, seq)
+	}
+	sort.Slice(q.seqs, func(i, j int) bool { return q.seqs[i] < q.seqs[j] })
+	if n := len(q.seqs); n > 0 {
+		q.next = q.seqs[n-1] + 1
+	}
+	return q, nil
+}
+
+// Len returns the number of queued requests.
+func (q *queue) Len() int {
+	return len(q.seqs)
+}
+
+// Push adds a request to the end of the queue. If the queue is full,
+// the oldest requests are dropped and their number returned.
+func (q *queue) Push(req []byte) (dropped int, err error) {
+	seq := q.next
+	path := q.path(seq)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, req, 0644); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return 0, err
+	}
+	q.next++
+	q.seqs = append(q.seqs, seq)
+	for q.Len() > q.max {
+		if err := q.Pop(); err != nil {
+			return dropped, err
+		}
+		dropped++
+	}
+	return dropped, nil
+}
+
+// Peek returns the oldest request.
+func (q *queue) Peek() ([]byte, error) {
+	return os.ReadFile(q.path(q.seqs[0]))
+}
+
+// Pop removes the oldest request.
+func (q *queue) Pop() error {
+	if err := os.Remove(q.path(q.seqs[0])); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	q.seqs = q.seqs[1:]
+	return nil
+}
+
+func (q *queue) path(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", seq, walSuffix))
+}
@@ -28,15 +28,24 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/joneskoo/ruuvi-prometheus/bluetooth"
+	"github.com/joneskoo/ruuvi-prometheus/capture"
+	"github.com/joneskoo/ruuvi-prometheus/config"
+	"github.com/joneskoo/ruuvi-prometheus/influx"
 	"github.com/joneskoo/ruuvi-prometheus/metrics"
+	"github.com/joneskoo/ruuvi-prometheus/mqtt"
+	"github.com/joneskoo/ruuvi-prometheus/remotewrite"
+	"gitlab.com/jtaimisto/bluewalker/hci"
 	"gitlab.com/jtaimisto/bluewalker/host"
 	"gitlab.com/jtaimisto/bluewalker/ruuvi"
 )
@@ -48,11 +57,21 @@ const (
 
 	// commandName is the name of this command used in help texts.
 	commandName = "ruuvi-prometheus"
+
+	// shutdownTimeout is the time the HTTP server waits for requests
+	// in progress to complete on shutdown.
+	shutdownTimeout = 5 * time.Second
+
+	// replayAdapter is the adapter name of replayed advertisements.
+	replayAdapter = "replay"
 )
 
 var version = ""
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "discover" {
+		os.Exit(discover(os.Args[2:]))
+	}
 	cmdline := parseSettings()
 
 	log.Printf("%s %s listening on %v", commandName, version, cmdline.listen)
@@ -62,14 +81,129 @@ func main() {
 		log.SetOutput(ioutil.Discard)
 	}
 
+	var cfg *config.Config
+	if cmdline.configFile != "" {
+		var err error
+		cfg, err = config.Load(cmdline.configFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", commandName, err)
+			os.Exit(2)
+		}
+	}
+
+	var publisher *mqtt.Publisher
+	if cmdline.mqttBroker != "" {
+		var err error
+		publisher, err = mqtt.NewPublisher(mqtt.PublisherOpts{
+			Broker:          cmdline.mqttBroker,
+			ClientID:        cmdline.mqttClientID,
+			Topic:           cmdline.mqttTopic,
+			QoS:             cmdline.mqttQoS,
+			Retain:          cmdline.mqttRetain,
+			Config:          cfg,
+			Discovery:       cmdline.mqttDiscovery,
+			DiscoveryPrefix: cmdline.mqttDiscoveryPrefix,
+			Logger:          getDebugLogger(cmdline.debug),
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", commandName, err)
+			os.Exit(2)
+		}
+	}
+
+	var influxWriter *influx.Writer
+	if cmdline.influxDestination != "" {
+		var err error
+		influxWriter, err = influx.NewWriter(influx.WriterOpts{
+			Destination:   cmdline.influxDestination,
+			Token:         cmdline.influxToken,
+			Measurement:   cmdline.influxMeasurement,
+			FlushInterval: cmdline.influxFlushInterval,
+			Config:        cfg,
+			Logger:        getDebugLogger(cmdline.debug),
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", commandName, err)
+			os.Exit(2)
+		}
+	}
+
+	exporter := metrics.New(metrics.ExporterOpts{
+		TTL:         cmdline.expire,
+		KeepExpired: cmdline.keepExpired,
+		Timestamps:  cmdline.timestamps,
+		ExportRaw:   cmdline.exportRaw,
+		Altitude:    cmdline.altitude,
+		Config:      cfg,
+		OnExpire: func(device string) {
+			// Devices kept with -expire-keep stay in Home Assistant.
+			if publisher != nil && !cmdline.keepExpired {
+				publisher.Expire(device)
+			}
+		},
+	})
+
+	filter := newDeviceFilter(cmdline.filter, cfg, exporter.ObserveFiltered)
+
+	// The exporter calibrates the readings and passes them on to the
+	// other outputs.
+	var outputs []output
+	if publisher != nil {
+		outputs = append(outputs, publisher)
+	}
+	if influxWriter != nil {
+		outputs = append(outputs, influxWriter)
+	}
+
+	var pusher *remotewrite.Pusher
+	if cmdline.remoteWriteURL != "" {
+		instance, _ := os.Hostname()
+		var err error
+		pusher, err = remotewrite.NewPusher(remotewrite.PusherOpts{
+			URL:         cmdline.remoteWriteURL,
+			BearerToken: cmdline.remoteWriteToken,
+			Gatherer:    exporter.Gatherer(),
+			Labels:      map[string]string{"job": commandName, "instance": instance},
+			Interval:    cmdline.remoteWriteInterval,
+			Dir:         cmdline.remoteWriteDir,
+			Logger:      getDebugLogger(cmdline.debug),
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", commandName, err)
+			os.Exit(2)
+		}
+	}
+
 	server := http.Server{
 		Addr:    cmdline.listen,
-		Handler: metrics.Handler,
+		Handler: exporter.Handler(),
+	}
+	server.RegisterOnShutdown(exporter.EndStreams)
+	var recorder *capture.Recorder
+	if cmdline.recordFile != "" && cmdline.replayFile == "" {
+		var err error
+		recorder, err = capture.NewRecorder(capture.RecorderOpts{
+			Path:       cmdline.recordFile,
+			MaxSize:    cmdline.recordMaxSize,
+			MaxBackups: cmdline.recordMaxBackups,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", commandName, err)
+			os.Exit(2)
+		}
+	}
+
+	var scanners []*bluetooth.Scanner
+	for _, device := range cmdline.devices {
+		opts := bluetooth.ScannerOpts{
+			Device: device,
+			Logger: getDebugLogger(cmdline.debug),
+		}
+		if recorder != nil {
+			opts.Record = recorder.Record
+		}
+		scanners = append(scanners, bluetooth.New(opts))
 	}
-	scanner := bluetooth.New(bluetooth.ScannerOpts{
-		Device: cmdline.device,
-		Logger: getDebugLogger(cmdline.debug),
-	})
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -81,6 +215,19 @@ func main() {
 		cancel()
 	}()
 
+	// Configuration reload
+	go func() {
+		sighup := make(chan os.Signal, 1)
+		signal.Notify(sighup, syscall.SIGHUP)
+		for range sighup {
+			// Reported like startup errors, as the log is discarded
+			// without -debug.
+			if err := reloadConfig(exporter, outputs, filter, cmdline.configFile); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: reload configuration: %v\n", commandName, err)
+			}
+		}
+	}()
+
 	// HTTP listener
 	go func() {
 		if err := server.ListenAndServe(); err != http.ErrServerClosed {
@@ -89,26 +236,95 @@ func main() {
 		cancel()
 	}()
 
-	// Bluetooth scanner
-	go func() {
-		scanner.HandleAdvertisement(handleRuuviAdvertisement)
-		err := scanner.Scan()
-		if err != nil {
-			log.Printf("Bluetooth scanner Scan: %v", err)
+	if cmdline.replayFile != "" {
+		// Capture replay; the HTTP listener keeps running after the
+		// capture ends so that the results can be inspected.
+		handle := func(rec capture.Record) {
+			handleRuuviAdvertisement(outputs, filter, exporter, replayAdapter, rec.Time, rec.Report)
 		}
-		cancel()
-	}()
+		go func() {
+			if err := replay(ctx, cmdline.replayFile, cmdline.replayRealtime, handle); err != nil {
+				log.Printf("Replay: %v", err)
+				cancel()
+				return
+			}
+			log.Printf("Replay of %s finished", cmdline.replayFile)
+		}()
+	} else {
+		// Bluetooth scanner
+		for i, scanner := range scanners {
+			adapter := cmdline.devices[i]
+			scanner.HandleAdvertisement(func(sr *host.ScanReport) {
+				handleRuuviAdvertisement(outputs, filter, exporter, adapter, time.Now(), sr)
+			})
+			go func(scanner *bluetooth.Scanner) {
+				err := scanner.Scan()
+				if err != nil {
+					log.Printf("Bluetooth scanner %s Scan: %v", adapter, err)
+				}
+				cancel()
+			}(scanner)
+		}
+	}
 
 	<-ctx.Done()
 
-	if err := server.Shutdown(context.Background()); err != nil {
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
 		log.Printf("HTTP server Shutdown: %v", err)
 	}
 
-	scanner.Shutdown()
+	for _, scanner := range scanners {
+		scanner.Shutdown()
+	}
+	if pusher != nil {
+		pusher.Close()
+	}
+	exporter.Close()
+	if publisher != nil {
+		publisher.Close()
+	}
+	if influxWriter != nil {
+		influxWriter.Close()
+	}
+	if recorder != nil {
+		if err := recorder.Close(); err != nil {
+			log.Printf("Recorder Close: %v", err)
+		}
+	}
 	os.Exit(1)
 }
 
+// reloadConfig loads the configuration file again. The previous
+// configuration stays in effect if the file can not be loaded.
+func reloadConfig(exporter *metrics.Exporter, outputs []output, filter *deviceFilter, path string) error {
+	if path == "" {
+		return nil
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		return err
+	}
+	filter.SetConfig(cfg)
+	exporter.SetConfig(cfg)
+	for _, out := range outputs {
+		out.SetConfig(cfg)
+	}
+	log.Printf("Reloaded configuration from %s", path)
+	return nil
+}
+
+// replay replays the advertisements in the capture file at path.
+func replay(ctx context.Context, path string, realtime bool, handle func(capture.Record)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return capture.Replay(ctx, f, realtime, handle)
+}
+
 func getDebugLogger(debug bool) *log.Logger {
 	var output io.Writer = os.Stderr
 	if !debug {
@@ -117,15 +333,41 @@ func getDebugLogger(debug bool) *log.Logger {
 	return log.New(output, "DEBUG: ", log.LstdFlags)
 }
 
-func handleRuuviAdvertisement(sr *host.ScanReport) {
+// output receives the decoded Ruuvi readings.
+type output interface {
+	Observe(metrics.RuuviReading)
+	SetConfig(*config.Config)
+}
+
+// handleRuuviAdvertisement decodes the advertisement sr received by
+// adapter at received and passes the readings to the exporter and the
+// outputs.
+func handleRuuviAdvertisement(outputs []output, filter *deviceFilter, exporter *metrics.Exporter, adapter string, received time.Time, sr *host.ScanReport) {
+	// The scanner only passes Ruuvi advertisements, so the filter is
+	// applied before decoding.
+	if !filter.Allowed(sr.Address.String()) {
+		return
+	}
 	for _, ads := range sr.Data {
+		// The other AD structures, e.g. flags, do not carry Ruuvi data.
+		if ads.Typ != hci.AdManufacturerSpecific {
+			continue
+		}
 		ruuviData, err := ruuvi.Decode(ads.Data)
 		if err != nil {
 			log.Printf("Unable to parse ruuvi data: %v; ads.Data=%x, len=%d, address=%x", err, ads.Data, len(ads.Data), sr.Address)
+			exporter.ObserveDecodeError(sr.Address.String(), ads.Data)
 			continue
 		}
 
-		reading := metrics.RuuviReading{ScanReport: sr, Data: ruuviData}
-		metrics.ObserveRuuvi(reading)
+		reading, measurement := exporter.Observe(metrics.RuuviReading{ScanReport: sr, Data: ruuviData, Adapter: adapter, Time: received})
+		// Repeated transmissions and frames received by more than one
+		// adapter are passed on once.
+		if !measurement {
+			continue
+		}
+		for _, out := range outputs {
+			out.Observe(reading)
+		}
 	}
 }
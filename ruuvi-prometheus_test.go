@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/joneskoo/ruuvi-prometheus/config"
+	"github.com/joneskoo/ruuvi-prometheus/metrics"
+	"gitlab.com/jtaimisto/bluewalker/hci"
+)
+
+type recordingOutput struct{ readings []metrics.RuuviReading }
+
+func (r *recordingOutput) Observe(o metrics.RuuviReading) { r.readings = append(r.readings, o) }
+func (r *recordingOutput) SetConfig(*config.Config)       {}
+
+// TestHandleCalibrated checks that every output receives the calibrated
+// readings.
+func TestHandleCalibrated(t *testing.T) {
+	cfg, err := config.Parse([]byte(`
+devices:
+  ee:36:80:be:ec:fd:
+    calibration:
+      temperature: {offset: -0.5}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter := metrics.New(metrics.ExporterOpts{Config: cfg})
+	defer exporter.Close()
+	out := &recordingOutput{}
+	filter := newDeviceFilter(config.Filter{}, cfg, nil)
+
+	sr := scanReport(t, "ee:36:80:be:ec:fd", -60, v6Frame)
+	sr.Data[0].Typ = hci.AdManufacturerSpecific
+	handleRuuviAdvertisement([]output{out}, filter, exporter, "hci0", time.Now(), sr)
+
+	if len(out.readings) != 1 {
+		t.Fatalf("%d readings, expected 1", len(out.readings))
+	}
+	o := out.readings[0]
+	if o.Temperature != float32(23.795)-0.5 || o.Raw == nil || o.Raw.Temperature != 23.795 {
+		t.Errorf("temperature %v, raw %v; expected 23.295, 23.795", o.Temperature, o.Raw)
+	}
+	d, _ := exporter.Device("ee:36:80:be:ec:fd")
+	if d.Readings["temperature"] != float64(o.Temperature) {
+		t.Errorf("exporter temperature %v, expected %v", d.Readings["temperature"], o.Temperature)
+	}
+}
+
+// TestHandleDuplicates checks that the outputs receive a measurement
+// once, however many times and by how many adapters it is received.
+func TestHandleDuplicates(t *testing.T) {
+	exporter := metrics.New(metrics.ExporterOpts{})
+	defer exporter.Close()
+	out := &recordingOutput{}
+	filter := newDeviceFilter(config.Filter{}, nil, nil)
+
+	for _, adapter := range []string{"hci0", "hci0", "hci1"} {
+		sr := scanReport(t, "ee:36:80:be:ec:fd", -60, v6Frame)
+		sr.Data[0].Typ = hci.AdManufacturerSpecific
+		handleRuuviAdvertisement([]output{out}, filter, exporter, adapter, time.Now(), sr)
+	}
+	if len(out.readings) != 1 {
+		t.Errorf("%d readings, expected 1", len(out.readings))
+	}
+}
+
+// TestReloadConfigError checks that a configuration that fails to load
+// is reported and the previous configuration kept.
+func TestReloadConfigError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("devices:\n  aa:bb:cc:dd:ee:ff:\n    labels: {device: y}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	exporter := metrics.New(metrics.ExporterOpts{})
+	defer exporter.Close()
+	filter := newDeviceFilter(config.Filter{}, nil, nil)
+	if err := reloadConfig(exporter, nil, filter, path); err == nil {
+		t.Error("reloadConfig: expected error for reserved label")
+	}
+}